@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// CertHasIdentity reports if the certificate was issued to the identity, either
+// as its common name or as one of its DNS names.
+func CertHasIdentity(cert *x509.Certificate, identity string) bool {
+	if cert.Subject.CommonName == identity {
+		return true
+	}
+	return len(cert.DNSNames) > 0 && cert.VerifyHostname(identity) == nil
+}
+
+// CertIdentities lists the identities of the certificate for error messages.
+func CertIdentities(cert *x509.Certificate) string {
+	identities := []string{}
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, "CN="+cert.Subject.CommonName)
+	}
+	for _, name := range cert.DNSNames {
+		identities = append(identities, "DNS:"+name)
+	}
+	if len(identities) == 0 {
+		return "no identity"
+	}
+	return strings.Join(identities, ", ")
+}
+
+// SPKIPin returns the base64 encoded sha256 hash of the certificate's subject
+// public key info.
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// SerialNumber hex encodes the serial number of the certificate the way it's
+// listed in the RevokedSerials.
+func SerialNumber(cert *x509.Certificate) string {
+	return strings.ToUpper(cert.SerialNumber.Text(16))
+}
+
+// ParseSerialNumber parses a hex encoded serial number.  Colons between the
+// bytes, as printed by openssl, are allowed.
+func ParseSerialNumber(serial string) (*big.Int, error) {
+	value := strings.TrimPrefix(strings.ToLower(strings.Replace(serial, ":", "", -1)), "0x")
+	result, ok := new(big.Int).SetString(value, 16)
+	if !ok || result.Sign() < 0 {
+		return nil, fmt.Errorf("invalid serial number '%s', expecting a hex encoded number", serial)
+	}
+	return result, nil
+}
@@ -0,0 +1,16 @@
+package certs
+
+import (
+	"github.com/spf13/cobra"
+)
+
+func New() *cobra.Command {
+	command := &cobra.Command{
+		Use:   `certs`,
+		Short: "manage the certificates of an existing importer and its exporters",
+	}
+	command.AddCommand(newIssue())
+	command.AddCommand(newRotate())
+	command.AddCommand(newRevoke())
+	return command
+}
@@ -0,0 +1,38 @@
+package certs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/chirino/svcteleporter/internal/cmd/install"
+	"github.com/chirino/svcteleporter/internal/pkg/pki"
+)
+
+// installConfigs generates the standalone configs, and the CA, of an importer and
+// an exporter that publishes the proxies in a temporary directory.  The files are
+// named after the returned prefix: ca.yaml, standalone-importer.yaml and
+// standalone-exporter.yaml.
+func installConfigs(t *testing.T, proxies ...cmd.ProxySpec) (prefix string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "svcteleporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix = filepath.Join(dir, "site-a-")
+	err = install.ConfigFiles(install.Options{
+		Kinds:            []string{"standalone"},
+		Duration:         24 * time.Hour,
+		KeyType:          pki.KeyTypeECDSAP256,
+		Prefix:           prefix,
+		ImporterHostPort: "importer.example.com:443",
+		Proxies:          proxies,
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return prefix, func() { os.RemoveAll(dir) }
+}
@@ -0,0 +1,170 @@
+package certs
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/chirino/svcteleporter/internal/cmd/importer"
+	"github.com/chirino/svcteleporter/internal/cmd/install"
+	"github.com/chirino/svcteleporter/internal/pkg/pki"
+	"github.com/chirino/svcteleporter/internal/pkg/utils"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/ssh"
+)
+
+// IssueOptions configures the exporter that gets enrolled with an existing importer.
+type IssueOptions struct {
+	CAFile             string
+	ImporterConfigFile string
+	Identity           string
+	KeyType            string
+	KeySize            int
+	Duration           time.Duration
+	Prefix             string
+	Kinds              []string
+
+	ImporterHostPort string
+	ExporterProxy    string
+	UpstreamProxy    string
+	Proxies          []cmd.ProxySpec
+	ReverseProxies   []cmd.ReverseProxySpec
+}
+
+func newIssue() *cobra.Command {
+	o := IssueOptions{}
+	reverseProxies := []string{}
+	command := &cobra.Command{
+		Use:   `issue [[kube-service[:port],]target-host:target:port]+`,
+		Short: "issue the certificate and config of an additional exporter",
+	}
+	command.Flags().StringVar(&o.CAFile, "ca", "ca.yaml", "the CA file written by install")
+	command.Flags().StringVar(&o.ImporterConfigFile, "importer-config", "standalone-importer.yaml", "the config of the importer the exporter connects to")
+	command.Flags().StringVar(&o.Identity, "identity", "exporter", "the identity (common name) of the exporter certificate")
+	command.Flags().StringVar(&o.ImporterHostPort, "importer-host-port", "", "The public hostname:port the importer runs at")
+	command.Flags().StringVar(&o.Prefix, "config-prefix", "", "config file prefix")
+	command.Flags().StringVar(&o.ExporterProxy, "exporter-proxy", "", "the http://[user:password@]host:port or socks5://[user:password@]host:port proxy the exporter uses to reach the importer")
+	command.Flags().StringVar(&o.UpstreamProxy, "upstream-proxy", "", "the socks5://[user:password@]host:port proxy the exporter uses to reach the upstream services")
+	command.Flags().StringArrayVar(&reverseProxies, "reverse", nil, "a kube-service:port[,listen-host:listen-port|unix:/listen/path] cluster service the exporter should expose locally. can be repeated.")
+	command.Flags().DurationVar(&o.Duration, "duration", 365*24*time.Hour, "duration that the exporter certificate will be valid for")
+	command.Flags().StringVar(&o.KeyType, "key-type", pki.KeyTypeECDSAP256, "the type of key to generate for the certificate. one of: "+strings.Join(pki.KeyTypes, ", ")+".")
+	command.Flags().IntVar(&o.KeySize, "key-size", 4096, "size of RSA key to generate.")
+	command.Flags().StringArrayVar(&o.Kinds, "output", []string{"openshift", "standalone"}, "the types of configuration outputs to generate. on of: openshif or standalone.")
+	command.RunE = func(c *cobra.Command, args []string) error {
+		if len(args) < 1 {
+			return fmt.Errorf("invalid usage. expecting:[proxy-port:target-host:target:port]+")
+		}
+		for _, arg := range args {
+			proxy, err := cmd.ParseProxySpec(arg)
+			if err != nil {
+				return err
+			}
+			o.Proxies = append(o.Proxies, proxy)
+		}
+		for _, arg := range reverseProxies {
+			proxy, err := cmd.ParseReverseProxySpec(arg)
+			if err != nil {
+				return err
+			}
+			o.ReverseProxies = append(o.ReverseProxies, proxy)
+		}
+		utils.ExitOnError(Issue(o))
+		return nil
+	}
+	return command
+}
+
+// Issue creates a new exporter certificate signed by the CA and writes the exporter
+// configs for it.  The importer config is only read, it does not need to change.
+func Issue(o IssueOptions) error {
+	if o.ImporterHostPort == "" {
+		return fmt.Errorf("the --importer-host-port is required")
+	}
+	caConfig, err := install.LoadCAConfigFile(o.CAFile)
+	if err != nil {
+		return fmt.Errorf("could not load the CA: %v", err)
+	}
+	ca, err := pki.LoadCA(caConfig.Cert, caConfig.Key)
+	if err != nil {
+		return err
+	}
+	ic, err := importer.LoadConfigFile(o.ImporterConfigFile)
+	if err != nil {
+		return fmt.Errorf("could not load the importer config: %v", err)
+	}
+
+	services := map[string]bool{}
+	for _, service := range ic.Services {
+		services[service.KubeService] = true
+	}
+	for _, proxy := range o.Proxies {
+		if !services[proxy.KubeService] {
+			return fmt.Errorf("the importer does not have a service named %s, it has: %s", proxy.KubeService, strings.Join(serviceNames(ic), ", "))
+		}
+	}
+	if err := cmd.ValidateServices(o.Proxies); err != nil {
+		return err
+	}
+
+	hostKey, err := ssh.ParsePrivateKey([]byte(ic.HostKey))
+	if err != nil {
+		return fmt.Errorf("the importer config does not have a valid HostKey: %v", err)
+	}
+	importerIdentity, err := importerCertIdentity(ic)
+	if err != nil {
+		return fmt.Errorf("invalid importer certificate: %v", err)
+	}
+
+	ec := cmd.ExporterConfig{
+		ImporterHostPort: o.ImporterHostPort,
+		ImporterHostKey:  strings.TrimSpace(string(ssh.MarshalAuthorizedKey(hostKey.PublicKey()))),
+		ImporterIdentity: importerIdentity,
+		Transport:        ic.Transport,
+		ImporterProxy:    o.ExporterProxy,
+		UpstreamProxy:    o.UpstreamProxy,
+		Proxies:          o.Proxies,
+		ReverseProxies:   o.ReverseProxies,
+		CAs:              append([]string{ca.CertPEM}, caConfig.Previous...),
+	}
+	ec.Cert, ec.Key, err = ca.Issue(o.KeyType, o.KeySize, o.Duration, o.Identity, x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		return err
+	}
+
+	err = install.ExporterConfigFiles(o.Prefix, o.Kinds, &ec)
+	if err != nil {
+		return err
+	}
+
+	if len(ic.Authorizations) > 0 {
+		fmt.Println("")
+		fmt.Printf("The importer uses Authorizations, add one for the '%s' identity so that it can publish its services.\n", o.Identity)
+	}
+	fmt.Println("")
+	fmt.Println("These files contain secrets.  Please be careful sharing them.")
+	return nil
+}
+
+func serviceNames(ic *cmd.ImporterConfig) []string {
+	names := []string{}
+	for _, service := range ic.Services {
+		names = append(names, service.KubeService)
+	}
+	return names
+}
+
+// importerCertIdentity is the identity of the importer certificate, which can be
+// referenced from a file.
+func importerCertIdentity(ic *cmd.ImporterConfig) (string, error) {
+	resolved, err := ic.ResolveTLS()
+	if err != nil {
+		return "", err
+	}
+	cert, err := parseCert(resolved.Cert)
+	if err != nil {
+		return "", err
+	}
+	return install.ImporterIdentity(cert)
+}
@@ -0,0 +1,123 @@
+package certs
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/chirino/svcteleporter/internal/cmd/exporter"
+	"github.com/chirino/svcteleporter/internal/cmd/importer"
+	"github.com/chirino/svcteleporter/internal/cmd/install"
+	"github.com/chirino/svcteleporter/internal/pkg/pki"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIssue(t *testing.T) {
+	prefix, cleanup := installConfigs(t,
+		cmd.ProxySpec{KubeService: "db", KubePort: 5432, UpstreamHost: "db.local", UpstreamPort: 5432},
+		cmd.ProxySpec{KubeService: "web", KubePort: 80, UpstreamHost: "web.local", UpstreamPort: 80},
+	)
+	defer cleanup()
+	dir := filepath.Dir(prefix)
+
+	o := IssueOptions{
+		CAFile:             prefix + "ca.yaml",
+		ImporterConfigFile: prefix + "standalone-importer.yaml",
+		Identity:           "site-b",
+		KeyType:            pki.KeyTypeECDSAP256,
+		Duration:           time.Hour,
+		Prefix:             filepath.Join(dir, "site-b-"),
+		Kinds:              []string{"standalone", "openshift"},
+		ImporterHostPort:   "importer.example.com:443",
+		Proxies:            []cmd.ProxySpec{{KubeService: "web", KubePort: 80, UpstreamHost: "10.0.0.1", UpstreamPort: 8080}},
+	}
+	if err := Issue(o); err != nil {
+		t.Fatal(err)
+	}
+	_, err := os.Stat(filepath.Join(dir, "site-b-openshift-exporter.yaml"))
+	assert.NoError(t, err)
+
+	ec, err := exporter.LoadConfigFile(filepath.Join(dir, "site-b-standalone-exporter.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := exporter.LoadConfigFile(prefix + "standalone-exporter.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, original.ImporterHostKey, ec.ImporterHostKey)
+
+	// the importer should trust the new exporter without any changes.
+	ic, err := importer.LoadConfigFile(o.ImporterConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	for _, ca := range ic.CAs {
+		roots.AppendCertsFromPEM([]byte(ca))
+	}
+	block, _ := pem.Decode([]byte(ec.Cert))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "site-b", cert.Subject.CommonName)
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+	assert.NoError(t, err)
+
+	o.Proxies = []cmd.ProxySpec{{KubeService: "unknown", KubePort: 80, UpstreamHost: "10.0.0.1", UpstreamPort: 80}}
+	assert.Error(t, Issue(o))
+}
+
+func TestIssueUsesImporterCertIdentity(t *testing.T) {
+	prefix, cleanup := installConfigs(t, cmd.ProxySpec{KubeService: "web", KubePort: 80, UpstreamHost: "web.local", UpstreamPort: 80})
+	defer cleanup()
+	dir := filepath.Dir(prefix)
+
+	// The importer runs with a certificate for another identity than the one
+	// install issues.
+	caConfig, err := install.LoadCAConfigFile(prefix + "ca.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := pki.LoadCA(caConfig.Cert, caConfig.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	importerFile := prefix + "standalone-importer.yaml"
+	ic, err := importer.LoadConfigFile(importerFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic.Cert, ic.Key, err = ca.Issue(pki.KeyTypeECDSAP256, 0, time.Hour, "importer.example.com", x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeConfig(importerFile, ic); err != nil {
+		t.Fatal(err)
+	}
+
+	err = Issue(IssueOptions{
+		CAFile:             prefix + "ca.yaml",
+		ImporterConfigFile: importerFile,
+		Identity:           "site-b",
+		KeyType:            pki.KeyTypeECDSAP256,
+		Duration:           time.Hour,
+		Prefix:             filepath.Join(dir, "site-b-"),
+		Kinds:              []string{"standalone"},
+		ImporterHostPort:   "importer.example.com:443",
+		Proxies:            []cmd.ProxySpec{{KubeService: "web", KubePort: 80, UpstreamHost: "10.0.0.1", UpstreamPort: 8080}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec, err := exporter.LoadConfigFile(filepath.Join(dir, "site-b-standalone-exporter.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, "importer.example.com", ec.ImporterIdentity)
+}
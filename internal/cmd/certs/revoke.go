@@ -0,0 +1,112 @@
+package certs
+
+import (
+	"fmt"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/chirino/svcteleporter/internal/cmd/exporter"
+	"github.com/chirino/svcteleporter/internal/cmd/importer"
+	"github.com/chirino/svcteleporter/internal/cmd/install"
+	"github.com/chirino/svcteleporter/internal/pkg/utils"
+	"github.com/spf13/cobra"
+)
+
+// RevokeOptions selects the exporter certificates that the importer should reject.
+type RevokeOptions struct {
+	install.Options
+	ImporterConfigFile  string
+	ExporterConfigFiles []string
+	// Serials are the hex encoded serial numbers of more certificates to revoke.
+	Serials []string
+	// UpdateSecret updates the importer's Secret in the cluster.
+	UpdateSecret bool
+}
+
+func newRevoke() *cobra.Command {
+	o := RevokeOptions{}
+	command := &cobra.Command{
+		Use:   `revoke [serial-number]*`,
+		Short: "revoke exporter certificates",
+		Long: `revoke adds the serial numbers of the exporter certificates to the RevokedSerials
+of the importer config.  The certificates are picked by the exporter configs that
+hold them or by their hex encoded serial numbers.  The importer reloads its config,
+rejects the revoked certificates and closes their established sessions.`,
+	}
+	install.AddClusterFlags(command, &o.Options)
+	command.Flags().StringVar(&o.ImporterConfigFile, "importer-config", "standalone-importer.yaml", "the importer config to update")
+	command.Flags().StringArrayVar(&o.ExporterConfigFiles, "exporter-config", nil, "the config of an exporter whose certificate gets revoked. can be repeated.")
+	command.Flags().BoolVar(&o.UpdateSecret, "update-secret", false, "update the Secret of the importer in the cluster")
+	command.RunE = func(c *cobra.Command, args []string) error {
+		o.Serials = args
+		utils.ExitOnError(Revoke(o))
+		return nil
+	}
+	return command
+}
+
+// Revoke adds the certificates to the RevokedSerials of the importer config.
+func Revoke(o RevokeOptions) error {
+	serials := []string{}
+	for _, serial := range o.Serials {
+		value, err := cmd.ParseSerialNumber(serial)
+		if err != nil {
+			return err
+		}
+		serials = append(serials, fmt.Sprintf("%X", value))
+	}
+	for _, file := range o.ExporterConfigFiles {
+		ec, err := exporter.LoadConfigFile(file)
+		if err != nil {
+			return fmt.Errorf("could not load the exporter config: %v", err)
+		}
+		ec, err = ec.ResolveTLS()
+		if err != nil {
+			return fmt.Errorf("could not load the exporter config: %v", err)
+		}
+		cert, err := parseCert(ec.Cert)
+		if err != nil {
+			return fmt.Errorf("invalid exporter certificate in %s: %v", file, err)
+		}
+		serials = append(serials, cmd.SerialNumber(cert))
+	}
+	if len(serials) == 0 {
+		return fmt.Errorf("expecting the serial numbers or the --exporter-config of the certificates to revoke")
+	}
+
+	ic, err := importer.LoadConfigFile(o.ImporterConfigFile)
+	if err != nil {
+		return fmt.Errorf("could not load the importer config: %v", err)
+	}
+	revoked := map[string]bool{}
+	for _, serial := range ic.RevokedSerials {
+		if value, err := cmd.ParseSerialNumber(serial); err == nil {
+			revoked[fmt.Sprintf("%X", value)] = true
+		}
+	}
+	for _, serial := range serials {
+		if revoked[serial] {
+			fmt.Println("already revoked: ", serial)
+			continue
+		}
+		revoked[serial] = true
+		ic.RevokedSerials = append(ic.RevokedSerials, serial)
+		fmt.Println("revoked: ", serial)
+	}
+
+	if err := writeConfig(o.ImporterConfigFile, ic); err != nil {
+		return err
+	}
+	if o.UpdateSecret {
+		resources, err := install.RenderImporter(ic)
+		if err != nil {
+			return err
+		}
+		if err := install.ApplySecrets(o.Options, resources); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("")
+	fmt.Println("The importer reloads its config, rejects the revoked certificates and closes their sessions.")
+	return nil
+}
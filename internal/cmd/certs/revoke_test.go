@@ -0,0 +1,45 @@
+package certs
+
+import (
+	"testing"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/chirino/svcteleporter/internal/cmd/exporter"
+	"github.com/chirino/svcteleporter/internal/cmd/importer"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevoke(t *testing.T) {
+	prefix, cleanup := installConfigs(t, cmd.ProxySpec{KubeService: "db", KubePort: 5432, UpstreamHost: "db.local", UpstreamPort: 5432})
+	defer cleanup()
+	ec, err := exporter.LoadConfigFile(prefix + "standalone-exporter.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := parseCert(ec.Cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := RevokeOptions{
+		ImporterConfigFile:  prefix + "standalone-importer.yaml",
+		ExporterConfigFiles: []string{prefix + "standalone-exporter.yaml"},
+		Serials:             []string{"0a:1b"},
+	}
+	if err := Revoke(o); err != nil {
+		t.Fatal(err)
+	}
+	// Revoking the same certificates again does not add duplicates.
+	o.Serials = []string{"A1B"}
+	if err := Revoke(o); err != nil {
+		t.Fatal(err)
+	}
+	ic, err := importer.LoadConfigFile(o.ImporterConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, []string{"A1B", cmd.SerialNumber(cert)}, ic.RevokedSerials)
+
+	assert.Error(t, Revoke(RevokeOptions{ImporterConfigFile: o.ImporterConfigFile}))
+	assert.Error(t, Revoke(RevokeOptions{ImporterConfigFile: o.ImporterConfigFile, Serials: []string{"not-hex"}}))
+}
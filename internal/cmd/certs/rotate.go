@@ -0,0 +1,267 @@
+package certs
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/chirino/svcteleporter/internal/cmd/exporter"
+	"github.com/chirino/svcteleporter/internal/cmd/importer"
+	"github.com/chirino/svcteleporter/internal/cmd/install"
+	"github.com/chirino/svcteleporter/internal/pkg/pki"
+	"github.com/chirino/svcteleporter/internal/pkg/utils"
+	"github.com/spf13/cobra"
+	"sigs.k8s.io/yaml"
+)
+
+// RotateOptions selects the CA and the configs that get new certificates.
+type RotateOptions struct {
+	install.Options
+	ImporterConfigFile  string
+	ExporterConfigFiles []string
+	// Finish ends the rotation by no longer trusting the previous CA.
+	Finish bool
+	// UpdateSecrets lists the Secrets to update in the cluster: importer and/or exporter.
+	UpdateSecrets []string
+}
+
+func newRotate() *cobra.Command {
+	o := RotateOptions{}
+	command := &cobra.Command{
+		Use:   `rotate`,
+		Short: "rotate the CA and the importer and exporter certificates",
+		Long: `rotate replaces the CA in two steps.  The first step creates the new CA, issues
+new exporter certificates and makes the importer and exporters trust both CAs, so
+that exporters can be updated one at a time.  Once all the exporters use their new
+configs, run rotate again with --finish to issue the new importer certificate and
+stop trusting the previous CA.`,
+	}
+	install.AddClusterFlags(command, &o.Options)
+	command.Flags().StringVar(&o.CAFile, "ca", "ca.yaml", "the CA file written by install")
+	command.Flags().StringVar(&o.ImporterConfigFile, "importer-config", "standalone-importer.yaml", "the importer config to update")
+	command.Flags().StringArrayVar(&o.ExporterConfigFiles, "exporter-config", []string{"standalone-exporter.yaml"}, "an exporter config to update. can be repeated.")
+	command.Flags().BoolVar(&o.Finish, "finish", false, "finish the rotation by issuing the new importer certificate and removing the previous CA from the configs")
+	command.Flags().StringArrayVar(&o.UpdateSecrets, "update-secret", nil, "update the Secret of the importer and/or exporter in the cluster. can be repeated.")
+	command.Flags().DurationVar(&o.Duration, "duration", 10*365*24*time.Hour, "duration that the new certificates will be valid for")
+	command.Flags().StringVar(&o.KeyType, "key-type", pki.KeyTypeECDSAP256, "the type of key to generate for the new CA and certificates. one of: "+strings.Join(pki.KeyTypes, ", ")+".")
+	command.Flags().IntVar(&o.KeySize, "key-size", 4096, "size of RSA key to generate.")
+	command.RunE = func(c *cobra.Command, args []string) error {
+		utils.ExitOnError(Rotate(o))
+		return nil
+	}
+	return command
+}
+
+// Rotate runs the first or, with Finish set, the second step of a CA rotation.
+func Rotate(o RotateOptions) error {
+	for _, secret := range o.UpdateSecrets {
+		switch secret {
+		case "importer":
+		case "exporter":
+			if len(o.ExporterConfigFiles) != 1 {
+				return fmt.Errorf("the exporter Secret can only be updated when rotating a single exporter config")
+			}
+		default:
+			return fmt.Errorf("invalid secret '%s', expecting one of: importer, exporter", secret)
+		}
+	}
+
+	caConfig, err := install.LoadCAConfigFile(o.CAFile)
+	if err != nil {
+		return fmt.Errorf("could not load the CA: %v", err)
+	}
+	ic, err := importer.LoadConfigFile(o.ImporterConfigFile)
+	if err != nil {
+		return fmt.Errorf("could not load the importer config: %v", err)
+	}
+	ecs := []*cmd.ExporterConfig{}
+	for _, file := range o.ExporterConfigFiles {
+		ec, err := exporter.LoadConfigFile(file)
+		if err != nil {
+			return fmt.Errorf("could not load the exporter config: %v", err)
+		}
+		ecs = append(ecs, ec)
+	}
+
+	if usesPEMRefs(ic.Cert, ic.Key, ic.CAs) {
+		return fmt.Errorf("the importer config references its certificates, rotate them where they are managed")
+	}
+	for i, ec := range ecs {
+		if usesPEMRefs(ec.Cert, ec.Key, ec.CAs) {
+			return fmt.Errorf("the exporter config %s references its certificates, rotate them where they are managed", o.ExporterConfigFiles[i])
+		}
+	}
+
+	if o.Finish {
+		// All the exporters trust the new CA by now, so the importer can switch over to
+		// a certificate issued by it.
+		if len(caConfig.Previous) == 0 {
+			return fmt.Errorf("there is no rotation to finish")
+		}
+		caConfig.Previous = nil
+		ca, err := pki.LoadCA(caConfig.Cert, caConfig.Key)
+		if err != nil {
+			return err
+		}
+		identity, err := certCommonName(ic.Cert)
+		if err != nil {
+			return fmt.Errorf("invalid importer certificate: %v", err)
+		}
+		pinned, err := pinnedImporterKey(ic, ecs, o.ExporterConfigFiles)
+		if err != nil {
+			return err
+		}
+		if pinned != nil {
+			// The exporters that pin the importer's key keep accepting it.
+			fmt.Println("The exporters pin the importer's key, the importer keeps its key pair.")
+			ic.Cert, err = ca.IssueForKey(pinned, o.Duration, identity, x509.ExtKeyUsageServerAuth)
+		} else {
+			ic.Cert, ic.Key, err = ca.Issue(o.KeyType, o.KeySize, o.Duration, identity, x509.ExtKeyUsageServerAuth)
+		}
+		if err != nil {
+			return err
+		}
+	} else {
+		// The importer keeps its certificate, which the exporters that have not been
+		// updated yet still trust, but it starts trusting the new CA.
+		if len(caConfig.Previous) > 0 {
+			return fmt.Errorf("a rotation is already in progress, finish it first with: svcteleporter certs rotate --finish")
+		}
+		ca, err := pki.NewCA(o.KeyType, o.KeySize, o.Duration, "svcteleporter-ca")
+		if err != nil {
+			return err
+		}
+		caConfig.Previous = []string{caConfig.Cert}
+		caConfig.Cert, caConfig.Key = ca.CertPEM, ca.KeyPEM
+
+		for _, ec := range ecs {
+			identity, err := certCommonName(ec.Cert)
+			if err != nil {
+				return fmt.Errorf("invalid exporter certificate: %v", err)
+			}
+			ec.Cert, ec.Key, err = ca.Issue(o.KeyType, o.KeySize, o.Duration, identity, x509.ExtKeyUsageClientAuth)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	cas := append([]string{caConfig.Cert}, caConfig.Previous...)
+	ic.CAs = cas
+	for _, ec := range ecs {
+		ec.CAs = cas
+	}
+
+	// Write the CA last so that a failure leaves a rotation that can be retried.
+	if err := writeConfig(o.ImporterConfigFile, ic); err != nil {
+		return err
+	}
+	for i, ec := range ecs {
+		if err := writeConfig(o.ExporterConfigFiles[i], ec); err != nil {
+			return err
+		}
+	}
+	if err := install.WriteCAConfigFile(o.CAFile, caConfig); err != nil {
+		return err
+	}
+
+	for _, secret := range o.UpdateSecrets {
+		var resources string
+		if secret == "importer" {
+			resources, err = install.RenderImporter(ic)
+		} else {
+			resources, err = install.RenderExporter(ecs[0])
+		}
+		if err != nil {
+			return err
+		}
+		if err := install.ApplySecrets(o.Options, resources); err != nil {
+			return err
+		}
+	}
+
+	fmt.Println("")
+	fmt.Println("The importer reloads its certificates without dropping any sessions.")
+	if o.Finish {
+		fmt.Println("Rotation finished, the previous CA is no longer trusted.")
+	} else {
+		fmt.Println("Once all the exporters use their new configs, finish the rotation with: svcteleporter certs rotate --finish")
+	}
+	return nil
+}
+
+// pinnedImporterKey returns the private key of the importer when one of the
+// exporters pins its public key with an ImporterSPKIPin, nil otherwise.  It fails
+// when an exporter pins another key since it would not accept the importer anyway.
+func pinnedImporterKey(ic *cmd.ImporterConfig, ecs []*cmd.ExporterConfig, files []string) (crypto.Signer, error) {
+	pair, err := tls.X509KeyPair([]byte(ic.Cert), []byte(ic.Key))
+	if err != nil {
+		return nil, fmt.Errorf("invalid importer certificate: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid importer certificate: %v", err)
+	}
+	pinned := false
+	for i, ec := range ecs {
+		if ec.ImporterSPKIPin == "" {
+			continue
+		}
+		if ec.ImporterSPKIPin != cmd.SPKIPin(leaf) {
+			return nil, fmt.Errorf("the exporter config %s pins another key than the importer's", files[i])
+		}
+		pinned = true
+	}
+	if !pinned {
+		return nil, nil
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("invalid importer certificate: unsupported private key type")
+	}
+	return key, nil
+}
+
+func usesPEMRefs(cert string, key string, cas []string) bool {
+	for _, value := range append([]string{cert, key}, cas...) {
+		if cmd.IsPEMRef(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func certCommonName(certPEM string) (string, error) {
+	cert, err := parseCert(certPEM)
+	if err != nil {
+		return "", err
+	}
+	return cert.Subject.CommonName, nil
+}
+
+func parseCert(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func writeConfig(file string, config interface{}) error {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(file, data, 0600)
+	if err != nil {
+		return err
+	}
+	fmt.Println("wrote: ", file)
+	return nil
+}
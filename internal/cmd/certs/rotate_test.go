@@ -0,0 +1,148 @@
+package certs
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/chirino/svcteleporter/internal/cmd/exporter"
+	"github.com/chirino/svcteleporter/internal/cmd/importer"
+	"github.com/chirino/svcteleporter/internal/pkg/pki"
+	"github.com/stretchr/testify/assert"
+)
+
+func verifies(t *testing.T, certPEM string, cas []string, usage x509.ExtKeyUsage) bool {
+	roots := x509.NewCertPool()
+	for _, ca := range cas {
+		roots.AppendCertsFromPEM([]byte(ca))
+	}
+	block, _ := pem.Decode([]byte(certPEM))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cert.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{usage}})
+	return err == nil
+}
+
+func TestRotate(t *testing.T) {
+	prefix, cleanup := installConfigs(t, cmd.ProxySpec{KubeService: "db", KubePort: 5432, UpstreamHost: "db.local", UpstreamPort: 5432})
+	defer cleanup()
+	o := RotateOptions{
+		ImporterConfigFile:  prefix + "standalone-importer.yaml",
+		ExporterConfigFiles: []string{prefix + "standalone-exporter.yaml"},
+	}
+	o.CAFile = prefix + "ca.yaml"
+	o.KeyType = pki.KeyTypeEd25519
+	o.Duration = time.Hour
+	oldExporter, err := exporter.LoadConfigFile(o.ExporterConfigFiles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Rotate(o); err != nil {
+		t.Fatal(err)
+	}
+	ic, err := importer.LoadConfigFile(o.ImporterConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec, err := exporter.LoadConfigFile(o.ExporterConfigFiles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, oldExporter.Cert, ec.Cert)
+	assert.Len(t, ic.CAs, 2)
+	// during the overlap, the importer accepts old and new exporter certs
+	assert.True(t, verifies(t, oldExporter.Cert, ic.CAs, x509.ExtKeyUsageClientAuth))
+	assert.True(t, verifies(t, ec.Cert, ic.CAs, x509.ExtKeyUsageClientAuth))
+	// and old and new exporters accept the importer cert.
+	assert.True(t, verifies(t, ic.Cert, oldExporter.CAs, x509.ExtKeyUsageServerAuth))
+	assert.True(t, verifies(t, ic.Cert, ec.CAs, x509.ExtKeyUsageServerAuth))
+
+	assert.Error(t, Rotate(o), "the rotation needs to be finished first")
+
+	o.Finish = true
+	if err := Rotate(o); err != nil {
+		t.Fatal(err)
+	}
+	ic, err = importer.LoadConfigFile(o.ImporterConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Len(t, ic.CAs, 1)
+	// the updated exporters accept the new importer cert
+	assert.True(t, verifies(t, ic.Cert, ec.CAs, x509.ExtKeyUsageServerAuth))
+	assert.False(t, verifies(t, ic.Cert, oldExporter.CAs, x509.ExtKeyUsageServerAuth))
+	assert.False(t, verifies(t, oldExporter.Cert, ic.CAs, x509.ExtKeyUsageClientAuth))
+	assert.True(t, verifies(t, ec.Cert, ic.CAs, x509.ExtKeyUsageClientAuth))
+}
+
+func certPin(t *testing.T, certPEM string) string {
+	cert, err := parseCert(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cmd.SPKIPin(cert)
+}
+
+func TestRotatePinnedExporter(t *testing.T) {
+	prefix, cleanup := installConfigs(t, cmd.ProxySpec{KubeService: "db", KubePort: 5432, UpstreamHost: "db.local", UpstreamPort: 5432})
+	defer cleanup()
+	o := RotateOptions{
+		ImporterConfigFile:  prefix + "standalone-importer.yaml",
+		ExporterConfigFiles: []string{prefix + "standalone-exporter.yaml"},
+	}
+	o.CAFile = prefix + "ca.yaml"
+	o.KeyType = pki.KeyTypeECDSAP256
+	o.Duration = time.Hour
+
+	// The exporter pins the key of the importer.
+	ic, err := importer.LoadConfigFile(o.ImporterConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pin := certPin(t, ic.Cert)
+	ec, err := exporter.LoadConfigFile(o.ExporterConfigFiles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec.ImporterSPKIPin = pin
+	if err := writeConfig(o.ExporterConfigFiles[0], ec); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Rotate(o); err != nil {
+		t.Fatal(err)
+	}
+	o.Finish = true
+	if err := Rotate(o); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := importer.LoadConfigFile(o.ImporterConfigFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec, err = exporter.LoadConfigFile(o.ExporterConfigFiles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(t, ic.Cert, rotated.Cert)
+	assert.Equal(t, pin, certPin(t, rotated.Cert), "the importer should keep the pinned key")
+	assert.Equal(t, pin, ec.ImporterSPKIPin)
+	assert.True(t, verifies(t, rotated.Cert, ec.CAs, x509.ExtKeyUsageServerAuth))
+
+	// An exporter that pins another key would not accept the importer.
+	ec.ImporterSPKIPin = certPin(t, ec.Cert)
+	if err := writeConfig(o.ExporterConfigFiles[0], ec); err != nil {
+		t.Fatal(err)
+	}
+	o.Finish = false
+	if err := Rotate(o); err != nil {
+		t.Fatal(err)
+	}
+	o.Finish = true
+	assert.Error(t, Rotate(o))
+}
@@ -6,16 +6,78 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var Version string = "latest"
 
+// Transports that the exporter can use to reach the importer.
+const (
+	// TransportTLS runs the ssh session directly over a mutual TLS connection.
+	TransportTLS = "tls"
+	// TransportWSS runs the ssh session over a secure web socket (wss) so that
+	// it can pass through HTTP(S) only proxies.  The importer still terminates
+	// the mutual TLS connection, so it can't sit behind an edge terminating
+	// Ingress or Route.
+	TransportWSS = "wss"
+)
+
 type ImporterConfig struct {
-	Cert     string
-	Key      string
-	CAs      []string
-	Listen   string
+	Cert   string
+	Key    string
+	CAs    []string
+	Listen string
+	// Transport is the transport the exporters connect with, TransportTLS when
+	// empty.
+	Transport string `json:",omitempty"`
+	// HostKey is the PEM encoded private key the importer's ssh server identifies
+	// itself with.
+	HostKey  string `json:",omitempty"`
 	Services []ProxySpec
+	// ReverseServices are the host:port cluster destinations that exporters are
+	// allowed to reach through the importer.  All other destinations are denied.
+	ReverseServices []string `json:",omitempty"`
+	// DestinationPolicy allows exporters to reach more cluster destinations than
+	// the ReverseServices.
+	DestinationPolicy *DestinationPolicy `json:",omitempty"`
+	// Authorizations limit which services an exporter can publish based on the
+	// identity of its client certificate.  When not set, any exporter can publish
+	// any of the services.
+	Authorizations []Authorization `json:",omitempty"`
+	// CRL is a PEM encoded certificate revocation list signed by one of the CAs.
+	// The exporter certificates it lists are rejected.
+	CRL string `json:",omitempty"`
+	// RevokedSerials are the hex encoded serial numbers of the exporter
+	// certificates that are rejected.
+	RevokedSerials []string `json:",omitempty"`
+	// ServicePortBase is the first port used for services that don't configure
+	// a ListenPort.
+	ServicePortBase uint32 `json:",omitempty"`
+	// UDPIdleTimeout is how long a udp client can go without sending or receiving
+	// a datagram before its session is closed.
+	UDPIdleTimeout Duration `json:",omitempty"`
+	// DrainTimeout is how long a shutdown waits for the in-flight connections to
+	// finish before closing them.
+	DrainTimeout Duration `json:",omitempty"`
+	// MetricsListen is the host:port of the HTTP listener that serves the
+	// Prometheus metrics on /metrics.  Metrics are not served when it's not set.
+	MetricsListen string `json:",omitempty"`
+	// HealthListen is the host:port of the HTTP listener that serves the /healthz
+	// and /readyz probes.  It can be the same as the MetricsListen.
+	HealthListen string `json:",omitempty"`
+
+	KeepAlive *KeepAliveSpec `json:",omitempty"`
+}
+
+// CAConfig holds the certificate authority that issues the importer and exporter
+// certificates.  It's kept out of the importer and exporter configs so that the
+// CA key does not need to be deployed with them.
+type CAConfig struct {
+	Cert string
+	Key  string
+	// Previous are the certs of the CAs that were rotated out but are still trusted
+	// until the rotation is finished.
+	Previous []string `json:",omitempty"`
 }
 
 type ExporterConfig struct {
@@ -23,60 +85,408 @@ type ExporterConfig struct {
 	Key              string
 	CAs              []string
 	ImporterHostPort string
-	Proxies          []ProxySpec
+	// Transport is the transport used to connect to the importer, TransportTLS
+	// when empty.
+	Transport string `json:",omitempty"`
+	// ImporterHostKey is the public ssh host key of the importer in authorized_keys
+	// format.  The exporter refuses to talk to an importer with any other host key.
+	ImporterHostKey string `json:",omitempty"`
+	// ImporterIdentity is the common name or DNS name the importer's certificate
+	// must be issued to.
+	ImporterIdentity string `json:",omitempty"`
+	// ImporterSPKIPin is the base64 encoded sha256 hash of the importer
+	// certificate's public key.  When set, only that key is accepted.
+	ImporterSPKIPin string `json:",omitempty"`
+	// ImporterProxy is the http://[user:password@]host:port of the HTTP CONNECT
+	// proxy or the socks5://[user:password@]host:port of the SOCKS5 proxy used to
+	// reach the importer.  When not set, the HTTPS_PROXY and NO_PROXY environment
+	// variables are used.
+	ImporterProxy string `json:",omitempty"`
+	// UpstreamProxy is the socks5://[user:password@]host:port of the SOCKS5 proxy
+	// used to reach the exported upstream services.
+	UpstreamProxy string `json:",omitempty"`
+	Proxies       []ProxySpec
+	// ReverseProxies are the cluster services the exporter brings back by listening
+	// for connections locally and forwarding them to the importer.
+	ReverseProxies []ReverseProxySpec `json:",omitempty"`
+
+	// ReconnectMinDelay and ReconnectMaxDelay bound the exponential backoff used
+	// when the session to the importer is lost.
+	ReconnectMinDelay Duration `json:",omitempty"`
+	ReconnectMaxDelay Duration `json:",omitempty"`
+	// UDPIdleTimeout is how long a udp session can go without datagrams before
+	// it's closed.
+	UDPIdleTimeout Duration `json:",omitempty"`
+	// DrainTimeout is how long a shutdown waits for the in-flight connections to
+	// finish before closing them.
+	DrainTimeout Duration `json:",omitempty"`
+	// MetricsListen is the host:port of the HTTP listener that serves the
+	// Prometheus metrics on /metrics.  Metrics are not served when it's not set.
+	MetricsListen string `json:",omitempty"`
+	// HealthListen is the host:port of the HTTP listener that serves the /healthz
+	// and /readyz probes.  It can be the same as the MetricsListen.
+	HealthListen string `json:",omitempty"`
+
+	KeepAlive *KeepAliveSpec `json:",omitempty"`
+}
+
+// DestinationPolicy restricts the cluster destinations that exporters can open
+// direct-tcpip channels to.  Destinations that no rule allows are denied.
+type DestinationPolicy struct {
+	// Allow lists host:port patterns.  The host is a name, a *.domain wildcard, an
+	// IP, a CIDR or *.  CIDRs only match destinations given as IP addresses.  The
+	// port is a number, a low-high range or *.
+	Allow []string `json:",omitempty"`
+}
+
+// Authorization lets the exporters with a client certificate issued to Identity
+// (its common name or one of its DNS names) publish the Services.  Use * to allow
+// all the services.
+type Authorization struct {
+	Identity string
+	Services []string
+}
+
+const DefaultUDPIdleTimeout = 1 * time.Minute
+
+// DefaultDrainTimeout leaves time to close the connections within the 30 second
+// grace period that kube gives terminating pods.
+const DefaultDrainTimeout = 20 * time.Second
+
+const (
+	DefaultKeepAliveInterval  = 30 * time.Second
+	DefaultKeepAliveMaxMissed = 3
+)
+
+// KeepAliveSpec configures the ssh keepalive requests sent to the peer.  The ssh
+// session is torn down after MaxMissed consecutive keepalives go unanswered.
+type KeepAliveSpec struct {
+	Interval  Duration `json:",omitempty"`
+	MaxMissed int      `json:",omitempty"`
+	Disabled  bool     `json:",omitempty"`
 }
 
+// Enabled reports if keepalives should be sent.  They are enabled unless
+// explicitly disabled.
+func (k *KeepAliveSpec) Enabled() bool {
+	return k == nil || !k.Disabled
+}
+
+func (k *KeepAliveSpec) IntervalOrDefault() time.Duration {
+	if k == nil {
+		return DefaultKeepAliveInterval
+	}
+	return k.Interval.OrDefault(DefaultKeepAliveInterval)
+}
+
+func (k *KeepAliveSpec) MaxMissedOrDefault() int {
+	if k == nil || k.MaxMissed <= 0 {
+		return DefaultKeepAliveMaxMissed
+	}
+	return k.MaxMissed
+}
+
+// ValidateTransport returns an error if the transport is not one of the supported
+// transports.  An empty transport defaults to TransportTLS.
+func ValidateTransport(transport string) error {
+	switch transport {
+	case "", TransportTLS, TransportWSS:
+		return nil
+	}
+	return fmt.Errorf("invalid transport '%s', expecting one of: %s, %s", transport, TransportTLS, TransportWSS)
+}
+
+// Protocols a ProxySpec can teleport.
+const (
+	ProtocolTCP = "tcp"
+	ProtocolUDP = "udp"
+)
+
 type ProxySpec struct {
+	// Protocol is either tcp or udp.  Defaults to tcp.
+	Protocol     string `json:",omitempty"`
 	KubeService  string
 	KubePort     uint32
 	UpstreamHost string
 	UpstreamPort uint32
+
+	// ListenHost and ListenPort are where the importer accepts connections for the
+	// service.  They default to 0.0.0.0 and the importer's service port base plus
+	// the index of the service.
+	ListenHost string `json:",omitempty"`
+	ListenPort uint32 `json:",omitempty"`
+
+	// ListenPath is the path of the unix socket a standalone importer accepts
+	// connections on instead of ListenHost and ListenPort.
+	ListenPath string `json:",omitempty"`
+	// UpstreamPath is the path of the unix socket the exporter connects to
+	// instead of UpstreamHost and UpstreamPort.
+	UpstreamPath string `json:",omitempty"`
+}
+
+// IsUDP reports if the service carries datagrams instead of streams.
+func (p *ProxySpec) IsUDP() bool {
+	return p.Protocol == ProtocolUDP
+}
+
+// KubeProtocol returns the protocol in the form used by kube Service ports.
+func (p *ProxySpec) KubeProtocol() string {
+	if p.IsUDP() {
+		return "UDP"
+	}
+	return "TCP"
+}
+
+const (
+	DefaultServiceListenHost = "0.0.0.0"
+	DefaultServicePortBase   = 2000
+)
+
+// ServiceListenAddress returns the network and address the importer listens on
+// for the service at index i of the Services list.
+func (c *ImporterConfig) ServiceListenAddress(i int) (network string, address string) {
+	service := c.Services[i]
+	if service.ListenPath != "" {
+		return "unix", service.ListenPath
+	}
+	network = "tcp"
+	if service.IsUDP() {
+		network = "udp"
+	}
+	host := service.ListenHost
+	if host == "" {
+		host = DefaultServiceListenHost
+	}
+	port := service.ListenPort
+	if port == 0 {
+		base := c.ServicePortBase
+		if base == 0 {
+			base = DefaultServicePortBase
+		}
+		port = base + uint32(i)
+	}
+	return network, net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+// ValidateServices checks that every service is valid and has a unique name since
+// the exporter and importer use the names to match up the services.
+func ValidateServices(specs []ProxySpec) error {
+	names := map[string]bool{}
+	for _, spec := range specs {
+		switch spec.Protocol {
+		case "", ProtocolTCP, ProtocolUDP:
+		default:
+			return fmt.Errorf("service %s has an invalid protocol '%s', expecting one of: %s, %s", spec.KubeService, spec.Protocol, ProtocolTCP, ProtocolUDP)
+		}
+		if spec.IsUDP() && (spec.ListenPath != "" || spec.UpstreamPath != "") {
+			return fmt.Errorf("service %s: udp services can't use unix sockets", spec.KubeService)
+		}
+		if spec.KubeService == "" {
+			return fmt.Errorf("service %s does not have a name", spec.String())
+		}
+		if names[spec.KubeService] {
+			return fmt.Errorf("service name %s is used more than once", spec.KubeService)
+		}
+		names[spec.KubeService] = true
+	}
+	return nil
 }
 
 func (p *ProxySpec) String() string {
-	return fmt.Sprintf("%s:%d,%s:%d", p.KubeService, p.KubePort, p.UpstreamHost, p.UpstreamPort)
+	prefix := ""
+	if p.IsUDP() {
+		prefix = "udp:"
+	}
+	kubeSide := fmt.Sprintf("%s:%d", p.KubeService, p.KubePort)
+	if p.ListenPath != "" {
+		kubeSide = unixPrefix + p.ListenPath
+	}
+	upstreamSide := fmt.Sprintf("%s:%d", p.UpstreamHost, p.UpstreamPort)
+	if p.UpstreamPath != "" {
+		upstreamSide = unixPrefix + p.UpstreamPath
+	}
+	return prefix + kubeSide + "," + upstreamSide
 }
 
+const unixPrefix = "unix:"
+
+const proxySpecFormat = "[udp:][[kube-service:port|unix:/listen/path],](target-host:target-port|unix:/target/path)"
+
+// ParseProxySpec parses a proxy spec in the proxySpecFormat: the kube side comes
+// first and the upstream side second.
 func ParseProxySpec(service string) (spec ProxySpec, err error) {
+	service = strings.TrimSpace(service)
+	if strings.HasPrefix(service, "udp:") {
+		spec.Protocol = ProtocolUDP
+		service = strings.TrimPrefix(service, "udp:")
+	} else if strings.HasPrefix(service, "tcp:") {
+		service = strings.TrimPrefix(service, "tcp:")
+	}
+
 	splits := strings.Split(service, ",")
 	if len(splits) > 2 {
-		err = fmt.Errorf("Invalid format, expecting: [[kube-service[:port],]target-host:target:port]")
+		err = fmt.Errorf("Invalid format, expecting: %s", proxySpecFormat)
 		return
 	}
-
-	i := 0
-	host, port, err := net.SplitHostPort(strings.TrimSpace(splits[0]))
-	if err != nil {
-		return
+	for i := range splits {
+		splits[i] = strings.TrimSpace(splits[i])
 	}
-	i, err = strconv.Atoi(port)
-	if err != nil {
+	if len(splits) == 1 && strings.HasPrefix(splits[0], unixPrefix) {
+		err = fmt.Errorf("Invalid format, a unix socket target needs a kube-service:port or unix:/listen/path, expecting: %s", proxySpecFormat)
 		return
 	}
-	if len(splits) == 1 {
-		spec.KubeService = sanitizeKubeService(host)
-		spec.KubePort = uint32(i)
 
-		spec.UpstreamHost = host
-		spec.UpstreamPort = uint32(i)
-	} else {
-		spec.UpstreamHost = host
-		spec.UpstreamPort = uint32(i)
+	if len(splits) == 2 && strings.HasPrefix(splits[1], unixPrefix) {
+		spec.UpstreamPath = strings.TrimPrefix(splits[1], unixPrefix)
+		if spec.UpstreamPath == "" {
+			err = fmt.Errorf("Invalid format, missing the unix socket path of: %s", splits[1])
+			return
+		}
+	}
 
-		host, port, err = net.SplitHostPort(strings.TrimSpace(splits[1]))
-		if err != nil {
+	if strings.HasPrefix(splits[0], unixPrefix) {
+		spec.ListenPath = strings.TrimPrefix(splits[0], unixPrefix)
+		if spec.ListenPath == "" {
+			err = fmt.Errorf("Invalid format, missing the unix socket path of: %s", splits[0])
 			return
 		}
+		spec.KubeService = strings.Trim(sanitizeKubeService(spec.ListenPath), "-")
+	} else {
+		i := 0
+		host, port, err := net.SplitHostPort(splits[0])
+		if err != nil {
+			return spec, err
+		}
 		i, err = strconv.Atoi(port)
 		if err != nil {
-			return
+			return spec, err
+		}
+		if len(splits) == 1 {
+			spec.KubeService = sanitizeKubeService(host)
+			spec.KubePort = uint32(i)
+
+			spec.UpstreamHost = host
+			spec.UpstreamPort = uint32(i)
+			return spec, nil
 		}
 		spec.KubeService = host
 		spec.KubePort = uint32(i)
 	}
+
+	if spec.UpstreamPath == "" {
+		host, port, err := net.SplitHostPort(splits[1])
+		if err != nil {
+			return spec, err
+		}
+		i, err := strconv.Atoi(port)
+		if err != nil {
+			return spec, err
+		}
+		spec.UpstreamHost = host
+		spec.UpstreamPort = uint32(i)
+	}
+	if spec.IsUDP() && (spec.ListenPath != "" || spec.UpstreamPath != "") {
+		err = fmt.Errorf("Invalid format, udp services can't use unix sockets")
+	}
 	return
 }
 
+// ReverseProxySpec is a cluster service that is exposed on the exporter's side of
+// the tunnel.
+type ReverseProxySpec struct {
+	// KubeService and KubePort are the cluster destination the importer dials.
+	KubeService string
+	KubePort    uint32
+
+	// ListenHost and ListenPort are where the exporter accepts connections for the
+	// service.  They default to 127.0.0.1 and the KubePort.
+	ListenHost string `json:",omitempty"`
+	ListenPort uint32 `json:",omitempty"`
+	// ListenPath is the path of the unix socket the exporter accepts connections
+	// on instead of ListenHost and ListenPort.
+	ListenPath string `json:",omitempty"`
+}
+
+const DefaultReverseListenHost = "127.0.0.1"
+
+// Target returns the host:port of the cluster destination.
+func (p *ReverseProxySpec) Target() string {
+	return net.JoinHostPort(p.KubeService, strconv.Itoa(int(p.KubePort)))
+}
+
+// ListenAddress returns the network and address the exporter listens on.
+func (p *ReverseProxySpec) ListenAddress() (network string, address string) {
+	if p.ListenPath != "" {
+		return "unix", p.ListenPath
+	}
+	host := p.ListenHost
+	if host == "" {
+		host = DefaultReverseListenHost
+	}
+	port := p.ListenPort
+	if port == 0 {
+		port = p.KubePort
+	}
+	return "tcp", net.JoinHostPort(host, strconv.Itoa(int(port)))
+}
+
+func (p *ReverseProxySpec) String() string {
+	if p.ListenPath != "" {
+		return p.Target() + "," + unixPrefix + p.ListenPath
+	}
+	if p.ListenHost == "" && p.ListenPort == 0 {
+		return p.Target()
+	}
+	_, address := p.ListenAddress()
+	return p.Target() + "," + address
+}
+
+const reverseProxySpecFormat = "kube-service:port[,listen-host:listen-port|unix:/listen/path]"
+
+func ParseReverseProxySpec(service string) (spec ReverseProxySpec, err error) {
+	splits := strings.Split(strings.TrimSpace(service), ",")
+	if len(splits) > 2 {
+		err = fmt.Errorf("Invalid format, expecting: %s", reverseProxySpecFormat)
+		return
+	}
+	for i := range splits {
+		splits[i] = strings.TrimSpace(splits[i])
+	}
+
+	host, port, err := net.SplitHostPort(splits[0])
+	if err != nil {
+		return spec, err
+	}
+	i, err := strconv.Atoi(port)
+	if err != nil {
+		return spec, err
+	}
+	spec.KubeService = host
+	spec.KubePort = uint32(i)
+	if len(splits) == 1 {
+		return spec, nil
+	}
+
+	if strings.HasPrefix(splits[1], unixPrefix) {
+		spec.ListenPath = strings.TrimPrefix(splits[1], unixPrefix)
+		if spec.ListenPath == "" {
+			err = fmt.Errorf("Invalid format, missing the unix socket path of: %s", splits[1])
+		}
+		return
+	}
+	host, port, err = net.SplitHostPort(splits[1])
+	if err != nil {
+		return spec, err
+	}
+	i, err = strconv.Atoi(port)
+	if err != nil {
+		return spec, err
+	}
+	spec.ListenHost = host
+	spec.ListenPort = uint32(i)
+	return spec, nil
+}
+
 func sanitizeKubeService(name string) string {
 	return regexp.MustCompile("[^a-zA-Z0-9]+").ReplaceAllString(name, "-")
 }
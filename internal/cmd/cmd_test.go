@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"github.com/magiconair/properties/assert"
+	"sigs.k8s.io/yaml"
 	"testing"
 )
 
@@ -21,4 +22,135 @@ func TestParseProxySpec(t *testing.T) {
 		UpstreamPort: 23,
 	})
 
+	// The kube side comes first for the udp and unix socket forms too.
+	spec, err = ParseProxySpec("udp:dns:53,10.0.0.2:5353")
+	if err != nil {
+		t.FailNow()
+	}
+	assert.Equal(t, spec, ProxySpec{
+		Protocol:     ProtocolUDP,
+		KubeService:  "dns",
+		KubePort:     53,
+		UpstreamHost: "10.0.0.2",
+		UpstreamPort: 5353,
+	})
+	spec, err = ParseProxySpec("docker:2375,unix:/var/run/docker.sock")
+	if err != nil {
+		t.FailNow()
+	}
+	assert.Equal(t, spec, ProxySpec{
+		KubeService:  "docker",
+		KubePort:     2375,
+		UpstreamPath: "/var/run/docker.sock",
+	})
+
+}
+
+func TestValidateServices(t *testing.T) {
+	err := ValidateServices([]ProxySpec{
+		{KubeService: "db", KubePort: 5432},
+		{KubeService: "web", KubePort: 80},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ValidateServices([]ProxySpec{
+		{KubeService: "db", KubePort: 5432},
+		{KubeService: "db", KubePort: 5433},
+	})
+	if err == nil {
+		t.FailNow()
+	}
+}
+
+func TestParseUDPProxySpec(t *testing.T) {
+	spec, err := ParseProxySpec("udp:dns:53,10.0.0.2:53")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, spec, ProxySpec{
+		Protocol:     ProtocolUDP,
+		KubeService:  "dns",
+		KubePort:     53,
+		UpstreamHost: "10.0.0.2",
+		UpstreamPort: 53,
+	})
+	assert.Equal(t, spec.String(), "udp:dns:53,10.0.0.2:53")
+	assert.Equal(t, spec.KubeProtocol(), "UDP")
+}
+
+func TestParseUnixProxySpec(t *testing.T) {
+	spec, err := ParseProxySpec("db:5432,unix:/var/run/postgresql/.s.PGSQL.5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, spec, ProxySpec{
+		KubeService:  "db",
+		KubePort:     5432,
+		UpstreamPath: "/var/run/postgresql/.s.PGSQL.5432",
+	})
+	assert.Equal(t, spec.String(), "db:5432,unix:/var/run/postgresql/.s.PGSQL.5432")
+
+	spec, err = ParseProxySpec("unix:/tmp/docker.sock,unix:/var/run/docker.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, spec, ProxySpec{
+		KubeService:  "tmp-docker-sock",
+		ListenPath:   "/tmp/docker.sock",
+		UpstreamPath: "/var/run/docker.sock",
+	})
+	assert.Equal(t, spec.String(), "unix:/tmp/docker.sock,unix:/var/run/docker.sock")
+
+	// the spec should survive being written to and read from a config file.
+	data, err := yaml.Marshal(&ExporterConfig{Proxies: []ProxySpec{spec}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := ExporterConfig{}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, config.Proxies, []ProxySpec{spec})
+
+	if _, err := ParseProxySpec("unix:/var/run/docker.sock"); err == nil {
+		t.Fatal("expected an error for a unix target without a kube service")
+	}
+	if _, err := ParseProxySpec("udp:dns:53,unix:/tmp/dns.sock"); err == nil {
+		t.Fatal("expected an error for a udp unix socket")
+	}
+}
+
+func TestParseReverseProxySpec(t *testing.T) {
+	spec, err := ParseReverseProxySpec("postgres:5432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, spec, ReverseProxySpec{
+		KubeService: "postgres",
+		KubePort:    5432,
+	})
+	assert.Equal(t, spec.String(), "postgres:5432")
+	network, address := spec.ListenAddress()
+	assert.Equal(t, network, "tcp")
+	assert.Equal(t, address, "127.0.0.1:5432")
+
+	spec, err = ParseReverseProxySpec("postgres.db.svc:5432,0.0.0.0:15432")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, spec, ReverseProxySpec{
+		KubeService: "postgres.db.svc",
+		KubePort:    5432,
+		ListenHost:  "0.0.0.0",
+		ListenPort:  15432,
+	})
+	assert.Equal(t, spec.String(), "postgres.db.svc:5432,0.0.0.0:15432")
+
+	spec, err = ParseReverseProxySpec("postgres:5432,unix:/tmp/pg.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, spec.ListenPath, "/tmp/pg.sock")
+	assert.Equal(t, spec.String(), "postgres:5432,unix:/tmp/pg.sock")
 }
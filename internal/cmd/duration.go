@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Duration is a time.Duration that is stored in config files in a human
+// readable form like "1m30s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	text := ""
+	err := json.Unmarshal(data, &text)
+	if err != nil {
+		return err
+	}
+	value, err := time.ParseDuration(text)
+	if err != nil {
+		return err
+	}
+	*d = Duration(value)
+	return nil
+}
+
+// OrDefault returns the duration, or def if the duration was not configured.
+func (d Duration) OrDefault(def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return time.Duration(d)
+}
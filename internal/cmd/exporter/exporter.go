@@ -6,18 +6,27 @@ import (
 	"crypto/x509"
 	"fmt"
 	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/chirino/svcteleporter/internal/pkg/metrics"
+	"github.com/chirino/svcteleporter/internal/pkg/protocol"
 	"github.com/chirino/svcteleporter/internal/pkg/utils"
+	"github.com/chirino/svcteleporter/internal/pkg/utils/ws"
+	"github.com/gorilla/websocket"
 	"github.com/spf13/cobra"
 	"golang.org/x/crypto/ssh"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net"
 	"sigs.k8s.io/yaml"
+	"sync/atomic"
 	"time"
 )
 
 var ImporterHostPort=""
+var ImporterProxy = ""
+var MetricsListen = ""
+var HealthListen = ""
 
 func New() *cobra.Command {
 
@@ -28,14 +37,15 @@ func New() *cobra.Command {
 				return fmt.Errorf("expecting a config file argument")
 			}
 			log.Println("svcteleporter version:", cmd.Version)
-			config, err := LoadConfigFile(args[0])
-			utils.ExitOnError(err)
-			err = Serve(context.Background(), config)
+			err := ServeConfigFile(cmd.ShutdownContext(), args[0])
 			utils.ExitOnError(err)
 			return nil
 		},
 	}
 	command.Flags().StringVar(&ImporterHostPort, "importer-host-port", "", "The public hostname:port the importer runs at")
+	command.Flags().StringVar(&ImporterProxy, "importer-proxy", "", "The http://[user:password@]host:port or socks5://[user:password@]host:port proxy used to reach the importer. defaults to the HTTPS_PROXY environment variable")
+	command.Flags().StringVar(&MetricsListen, "metrics-listen", "", "The host:port to serve the Prometheus metrics on. overrides the MetricsListen config")
+	command.Flags().StringVar(&HealthListen, "health-listen", "", "The host:port to serve the /healthz and /readyz probes on. overrides the HealthListen config")
 	return command
 }
 
@@ -55,24 +65,241 @@ func LoadConfigFile(configFile string) (*cmd.ExporterConfig, error) {
 	return config, nil
 }
 
+const (
+	defaultReconnectMinDelay = 1 * time.Second
+	defaultReconnectMaxDelay = 1 * time.Minute
+)
+
+// Serve keeps a session to the importer open until the context is canceled.  When
+// the session is lost, it is re-established using a jittered exponential backoff.
+// Once the context is canceled, the forwards are canceled and the connections get
+// up to the DrainTimeout to close before the session is closed.
 func Serve(ctx context.Context, config *cmd.ExporterConfig) error {
+	return serve(ctx, config, nil)
+}
+
+// sessionSettings are derived from the config to establish the sessions.
+type sessionSettings struct {
+	tlsConfig       *tls.Config
+	hostKeyCallback ssh.HostKeyCallback
+	dialUpstream    dialFunc
+}
+
+func newSessionSettings(config *cmd.ExporterConfig) (*sessionSettings, error) {
+	if err := cmd.ValidateServices(config.Proxies); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback, err := newHostKeyCallback(config)
+	if err != nil {
+		return nil, err
+	}
+	dialUpstream, err := upstreamDialer(config)
+	if err != nil {
+		return nil, err
+	}
+	return &sessionSettings{
+		tlsConfig:       tlsConfig,
+		hostKeyCallback: hostKeyCallback,
+		dialUpstream:    dialUpstream,
+	}, nil
+}
+
+// applyFlags overrides the config with the command line flags.
+func applyFlags(config *cmd.ExporterConfig) {
+	if ImporterHostPort != "" {
+		config.ImporterHostPort = ImporterHostPort
+	}
+	if ImporterProxy != "" {
+		config.ImporterProxy = ImporterProxy
+	}
+	if MetricsListen != "" {
+		config.MetricsListen = MetricsListen
+	}
+	if HealthListen != "" {
+		config.HealthListen = HealthListen
+	}
+}
+
+type sessionResult struct {
+	established bool
+	err         error
+}
+
+// serve is Serve that also applies the configs received from reloads.
+func serve(ctx context.Context, config *cmd.ExporterConfig, reloads <-chan *cmd.ExporterConfig) error {
+	applyFlags(config)
+	settings, err := newSessionSettings(config)
+	if err != nil {
+		return err
+	}
+	streams := &utils.Streams{}
+	reverse, err := listenReverseProxies(config.ReverseProxies, streams)
+	if err != nil {
+		return err
+	}
+	defer reverse.Close()
+	services := newExportedServices(config.Proxies)
+	if err := cmd.ServeStatus(ctx, config.MetricsListen, config.HealthListen, services.ready, "exporter:"); err != nil {
+		return err
+	}
+
+	// New sessions use the latest certificates when the files they are loaded from
+	// change.
+	var currentConfig atomic.Value
+	currentConfig.Store(config)
+	tlsFilesChanged := make(chan struct{})
+	go cmd.WatchFiles(ctx, func() []string {
+		return currentConfig.Load().(*cmd.ExporterConfig).TLSFiles()
+	}, func() {
+		select {
+		case tlsFilesChanged <- struct{}{}:
+		case <-ctx.Done():
+		}
+	})
+
+	minDelay := config.ReconnectMinDelay.OrDefault(defaultReconnectMinDelay)
+	maxDelay := config.ReconnectMaxDelay.OrDefault(defaultReconnectMaxDelay)
+	delay := minDelay
+
+	var sessionDone chan sessionResult
+	var reconnect <-chan time.Time
+	cancelSession := func() {}
+	startSession := func() {
+		// The session outlives ctx so that it can drain the connections on shutdown.
+		sessionCtx, cancel := context.WithCancel(context.Background())
+		done := make(chan sessionResult, 1)
+		go func(config *cmd.ExporterConfig, settings *sessionSettings) {
+			established, err := serveSession(sessionCtx, config, settings, services, reverse, streams)
+			done <- sessionResult{established, err}
+		}(config, settings)
+		sessionDone, cancelSession = done, cancel
+	}
+	// shutdown stops accepting new connections, waits for the established ones to
+	// close and then closes the session.
+	shutdown := func() error {
+		reverse.Close()
+		services.cancel()
+		drainTimeout := config.DrainTimeout.OrDefault(cmd.DefaultDrainTimeout)
+		log.Println("exporter:shutting down, waiting up to", drainTimeout, "for", streams.Active(), "connections to close")
+		if !streams.Drain(drainTimeout) {
+			log.Println("exporter:drain timeout expired, closing", streams.Active(), "connections")
+		}
+		cancelSession()
+		if sessionDone != nil {
+			<-sessionDone
+		}
+		log.Println("exporter:shut down")
+		return nil
+	}
+	startSession()
+	for {
+		select {
+		case <-ctx.Done():
+			return shutdown()
+
+		case result := <-sessionDone:
+			sessionDone = nil
+			cancelSession()
+			if ctx.Err() != nil {
+				return nil
+			}
+			if result.established {
+				log.Println("exporter:session to importer lost:", result.err)
+				delay = minDelay
+			} else {
+				log.Println("exporter:could not establish session to importer:", result.err)
+			}
+			wait := jitter(delay)
+			log.Printf("exporter:reconnecting in %v\n", wait)
+			reconnect = time.After(wait)
+			delay *= 2
+			if delay > maxDelay {
+				delay = maxDelay
+			}
+
+		case <-reconnect:
+			reconnect = nil
+			startSession()
+
+		case <-tlsFilesChanged:
+			tlsConfig, err := newTLSConfig(config)
+			if err != nil {
+				log.Println("exporter:could not reload the TLS certificates:", err)
+				continue
+			}
+			settings = &sessionSettings{tlsConfig: tlsConfig, hostKeyCallback: settings.hostKeyCallback, dialUpstream: settings.dialUpstream}
+			log.Println("exporter:reloaded the TLS certificates")
+
+		case changed := <-reloads:
+			applyFlags(changed)
+			changedSettings, err := newSessionSettings(changed)
+			if err != nil {
+				log.Println("exporter:ignoring invalid config change:", err)
+				continue
+			}
+			if err := reverse.update(changed.ReverseProxies); err != nil {
+				log.Println("exporter:could not update the reverse proxies:", err)
+			}
+			services.update(changed.Proxies)
+			reconnectNeeded := sessionConfigChanged(config, changed)
+			if changed.MetricsListen != config.MetricsListen || changed.HealthListen != config.HealthListen {
+				log.Println("exporter:WARNING: changes to the MetricsListen or HealthListen settings are applied on the next restart")
+			}
+			config, settings = changed, changedSettings
+			currentConfig.Store(config)
+			minDelay = config.ReconnectMinDelay.OrDefault(defaultReconnectMinDelay)
+			maxDelay = config.ReconnectMaxDelay.OrDefault(defaultReconnectMaxDelay)
+			log.Println("exporter:applied the config change")
+			if reconnectNeeded && sessionDone != nil {
+				log.Println("exporter:the session settings changed, reconnecting to the importer")
+				cancelSession()
+				<-sessionDone
+				sessionDone = nil
+				delay = minDelay
+				startSession()
+			}
+		}
+	}
+}
+
+// jitter picks a random delay between half and all of the given delay so that
+// many exporters don't reconnect in lock step.
+func jitter(delay time.Duration) time.Duration {
+	half := int64(delay / 2)
+	if half <= 0 {
+		return delay
+	}
+	return time.Duration(half + rand.Int63n(half))
+}
+
+func newTLSConfig(config *cmd.ExporterConfig) (*tls.Config, error) {
+	config, err := config.ResolveTLS()
+	if err != nil {
+		return nil, err
+	}
 	publicKeyPem := []byte(config.Cert)
 	privateKeyPem := []byte(config.Key)
 	cert, err := tls.X509KeyPair(publicKeyPem, privateKeyPem)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	metrics.SetCertificate(cert)
 	caPool := x509.NewCertPool()
 	for _, ca := range config.CAs {
 		caPool.AppendCertsFromPEM([]byte(ca))
 	}
 
-	if ImporterHostPort != "" {
-		config.ImporterHostPort = ImporterHostPort
-	}
 	host, _, err := net.SplitHostPort(config.ImporterHostPort)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	verifyImporter, err := newImporterVerifier(config, caPool)
+	if err != nil {
+		return nil, err
 	}
 
 	tlsConfig := &tls.Config{
@@ -81,110 +308,266 @@ func Serve(ctx context.Context, config *cmd.ExporterConfig) error {
 		RootCAs:      caPool,
 		MinVersion:   tls.VersionTLS12,
 
-		// Lets skip hostname verification, but lets check it's a trusted cert.
-		InsecureSkipVerify: true,
-		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
-
-			certs := make([]*x509.Certificate, len(rawCerts))
-			for i, asn1Data := range rawCerts {
-				cert, err := x509.ParseCertificate(asn1Data)
-				if err != nil {
-					return err
-				}
-				certs[i] = cert
-			}
+		// The importer's certificate is not issued for the host name it is reached at,
+		// so the default verification is replaced by verifyImporter.
+		InsecureSkipVerify:    true,
+		VerifyPeerCertificate: verifyImporter,
+	}
 
-			opts := x509.VerifyOptions{
-				Roots:         caPool,
-				CurrentTime:   time.Now(),
-				DNSName:       certs[0].DNSNames[0],
-				Intermediates: x509.NewCertPool(),
-			}
+	tlsConfig.BuildNameToCertificate()
+	return tlsConfig, nil
+}
 
-			verifiedChains, err := certs[0].Verify(opts)
+// newImporterVerifier returns a VerifyPeerCertificate callback that checks the
+// importer's certificate chains up to one of the CAs and that it belongs to the
+// configured ImporterIdentity and/or matches the ImporterSPKIPin.
+func newImporterVerifier(config *cmd.ExporterConfig, caPool *x509.CertPool) (func([][]byte, [][]*x509.Certificate) error, error) {
+	if config.ImporterIdentity == "" && config.ImporterSPKIPin == "" {
+		return nil, fmt.Errorf("the config needs an ImporterIdentity or an ImporterSPKIPin to verify the importer")
+	}
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return fmt.Errorf("importer did not present a certificate")
+		}
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, asn1Data := range rawCerts {
+			cert, err := x509.ParseCertificate(asn1Data)
 			if err != nil {
-				return err
+				return fmt.Errorf("importer sent an invalid certificate: %v", err)
 			}
+			certs[i] = cert
+		}
 
-			return nil
-		},
+		opts := x509.VerifyOptions{
+			Roots:         caPool,
+			CurrentTime:   time.Now(),
+			Intermediates: x509.NewCertPool(),
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		if _, err := certs[0].Verify(opts); err != nil {
+			return fmt.Errorf("importer certificate is not trusted by the configured CAs: %v", err)
+		}
+
+		if config.ImporterIdentity != "" && !cmd.CertHasIdentity(certs[0], config.ImporterIdentity) {
+			return fmt.Errorf("importer certificate does not belong to the expected identity '%s', it was issued to: %s", config.ImporterIdentity, cmd.CertIdentities(certs[0]))
+		}
+		if config.ImporterSPKIPin != "" {
+			if pin := cmd.SPKIPin(certs[0]); pin != config.ImporterSPKIPin {
+				return fmt.Errorf("importer certificate public key pin %s does not match the ImporterSPKIPin", pin)
+			}
+		}
+		return nil
+	}, nil
+}
+
+// newHostKeyCallback returns a callback that only accepts the importer's host key.
+func newHostKeyCallback(config *cmd.ExporterConfig) (ssh.HostKeyCallback, error) {
+	if config.ImporterHostKey == "" {
+		return nil, fmt.Errorf("the config does not have an ImporterHostKey, regenerate it with: svcteleporter install")
 	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(config.ImporterHostKey))
+	if err != nil {
+		return nil, fmt.Errorf("invalid ImporterHostKey: %v", err)
+	}
+	return ssh.FixedHostKey(hostKey), nil
+}
 
-	tlsConfig.BuildNameToCertificate()
+// serveSession connects to the importer and services the port forwards until the
+// session is lost or the context is canceled.  established reports if the session
+// got far enough to get all the forwards registered with the importer.
+func serveSession(ctx context.Context, config *cmd.ExporterConfig, settings *sessionSettings, services *exportedServices, reverse *reverseForwards, streams *utils.Streams) (established bool, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	log.Println("exporter:tls dialing:", config.ImporterHostPort)
-	tlsConn, err := tls.Dial("tcp", config.ImporterHostPort, tlsConfig)
+	log.Println("exporter:connecting to importer:", config.ImporterHostPort)
+	conn, err := dialImporter(ctx, config, settings.tlsConfig)
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	sshConfig := &ssh.ClientConfig{
-		User: "testuser",
-		Auth: []ssh.AuthMethod{},
-	}
-	if sshConfig.HostKeyCallback == nil {
-		sshConfig.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		User:            "testuser",
+		Auth:            []ssh.AuthMethod{},
+		HostKeyCallback: settings.hostKeyCallback,
 	}
 
-	c, chans, reqs, err := ssh.NewClientConn(tlsConn, config.ImporterHostPort, sshConfig)
+	c, chans, reqs, err := ssh.NewClientConn(conn, config.ImporterHostPort, sshConfig)
 	if err != nil {
-		return err
+		conn.Close()
+		return false, err
+	}
+	sshConnection := ssh.NewClient(c, chans, services.handleRequests(reqs))
+	defer sshConnection.Close()
+	go func() {
+		<-ctx.Done()
+		sshConnection.Close()
+	}()
+	log.Println("exporter:connected to importer:", config.ImporterHostPort)
+	if config.KeepAlive.Enabled() {
+		go utils.KeepAlive(ctx, sshConnection, config.KeepAlive.IntervalOrDefault(), config.KeepAlive.MaxMissedOrDefault(), "exporter:")
 	}
-	sshConnection := ssh.NewClient(c, chans, reqs)
-
-	results := make(chan error)
-	for i, service := range config.Proxies {
 
-		targetAddressPort := fmt.Sprintf("%s:%d", service.UpstreamHost, service.UpstreamPort)
+	// Register the channel handler before requesting the forwards so that we don't miss
+	// any of the connections the importer forwards to us.
+	forwardedServices := sshConnection.HandleChannelOpen(protocol.ForwardedServiceChannel)
+	forwardedDatagrams := sshConnection.HandleChannelOpen(protocol.ForwardedDatagramChannel)
+	if err := services.register(sshConnection); err != nil {
+		return false, err
+	}
+	defer services.unregister()
+	log.Println("exporter:session established, all services exported")
+	sessionDown := metrics.SessionUp()
+	defer sessionDown()
+	reverse.setClient(sshConnection)
+	defer reverse.setClient(nil)
 
-		// Listen on remote server port
-		log.Println("exporter:opening listener for service ", targetAddressPort)
-		remoteHostPortListen, err := sshConnection.Listen("tcp", fmt.Sprintf("0.0.0.0:%d", 2000+i))
+	// acceptForward accepts the forwarded channel if it's for a service of the expected protocol.
+	acceptForward := func(newChannel ssh.NewChannel, udp bool) (ssh.Channel, cmd.ProxySpec, bool) {
+		payload := protocol.ForwardedService{}
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, "error parsing forward data: "+err.Error())
+			return nil, cmd.ProxySpec{}, false
+		}
+		service, ok := services.lookup(payload.Service)
+		if !ok || service.IsUDP() != udp {
+			newChannel.Reject(ssh.Prohibited, "unknown service: "+payload.Service)
+			return nil, service, false
+		}
+		channel, reqs, err := newChannel.Accept()
 		if err != nil {
-			return fmt.Errorf("export error: %s", err)
+			return nil, service, false
 		}
+		go ssh.DiscardRequests(reqs)
+		return channel, service, true
+	}
 
-		go func() {
-			defer remoteHostPortListen.Close()
-			for {
-				sshTunnel, err := remoteHostPortListen.Accept()
-				if err != nil {
-					results <- err
-					return
-				}
-				go onNewConnectionForward(sshTunnel, targetAddressPort)
+	results := make(chan error, 3)
+	go func() {
+		for newChannel := range forwardedServices {
+			if sshTunnel, service, ok := acceptForward(newChannel, false); ok {
+				network, address := upstreamAddress(service)
+				go onNewConnectionForward(ctx, sshTunnel, service.KubeService, network, address, settings.dialUpstream, streams)
 			}
-			results <- nil
-			log.Println("exporter:closing listener for service ", targetAddressPort)
-			return
-		}()
+		}
+		results <- fmt.Errorf("importer stopped forwarding connections")
+	}()
+	go func() {
+		udpIdleTimeout := config.UDPIdleTimeout.OrDefault(cmd.DefaultUDPIdleTimeout)
+		for newChannel := range forwardedDatagrams {
+			if sshTunnel, service, ok := acceptForward(newChannel, true); ok {
+				_, address := upstreamAddress(service)
+				go onNewDatagramForward(sshTunnel, service.KubeService, address, udpIdleTimeout, streams)
+			}
+		}
+		results <- fmt.Errorf("importer stopped forwarding datagrams")
+	}()
+
+	go func() {
+		results <- sshConnection.Wait()
+	}()
+	select {
+	case <-ctx.Done():
+		return true, nil
+	case err := <-results:
+		return true, err
 	}
+}
+
+// upstreamAddress returns the network and address of the service's upstream.
+func upstreamAddress(service cmd.ProxySpec) (network string, address string) {
+	if service.UpstreamPath != "" {
+		return "unix", service.UpstreamPath
+	}
+	network = "tcp"
+	if service.IsUDP() {
+		network = "udp"
+	}
+	return network, net.JoinHostPort(service.UpstreamHost, fmt.Sprint(service.UpstreamPort))
+}
 
-	for range config.Proxies {
-		err := <-results
+// handshakeTimeout limits the TLS or WebSocket handshake with the importer.
+const handshakeTimeout = 45 * time.Second
+
+// dialImporter opens the connection to the importer that the ssh session will run over
+// using the transport selected in the config.
+func dialImporter(ctx context.Context, config *cmd.ExporterConfig, tlsConfig *tls.Config) (net.Conn, error) {
+	dial, err := importerDialer(config)
+	if err != nil {
+		return nil, err
+	}
+	switch config.Transport {
+	case cmd.TransportWSS:
+		url := "wss://" + config.ImporterHostPort + "/"
+		log.Println("exporter:wss dialing:", url)
+		dialer := websocket.Dialer{
+			NetDialContext:   dial,
+			TLSClientConfig:  tlsConfig,
+			HandshakeTimeout: handshakeTimeout,
+		}
+		wsConn, _, err := dialer.DialContext(ctx, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		return ws.WebSocketToNetConn(ctx, wsConn, "exporter:wss "), nil
+	case "", cmd.TransportTLS:
+		log.Println("exporter:tls dialing:", config.ImporterHostPort)
+		conn, err := dial(ctx, "tcp", config.ImporterHostPort)
+		if err != nil {
+			return nil, err
+		}
+		// Give up on the handshake once it times out or the context is canceled so that
+		// an importer that doesn't answer can't hold up reloads and shutdowns.
+		conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		handshakeDone := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-handshakeDone:
+			}
+		}()
+		tlsConn := tls.Client(conn, tlsConfig)
+		err = tlsConn.Handshake()
+		close(handshakeDone)
 		if err != nil {
-			return err
+			conn.Close()
+			return nil, err
 		}
+		conn.SetDeadline(time.Time{})
+		return tlsConn, nil
+	default:
+		return nil, cmd.ValidateTransport(config.Transport)
 	}
-	return nil
 }
 
-func onNewConnectionForward(sshTunnel net.Conn, targetAddress string) {
+// onNewConnectionForward relays a connection forwarded by the importer to the
+// upstream of the service.  The connection is counted in streams until it closes.
+func onNewConnectionForward(ctx context.Context, sshTunnel io.ReadWriteCloser, service string, network string, targetAddress string, dialUpstream dialFunc, streams *utils.Streams) {
+	done := streams.Add()
 
 	log.Println("exporter:tunnel dialing upstream:", targetAddress)
-	targetConn, err := net.Dial("tcp", targetAddress)
+	started := time.Now()
+	targetConn, err := dialUpstream(ctx, network, targetAddress)
+	metrics.UpstreamDial(service, started, err)
 	if err != nil {
 		sshTunnel.Close()
+		done()
 		log.Println("exporter:tunnel dial error:", err)
 		return
 	}
+	connDone := metrics.Connection(service)
 
 	// Start remote -> local data transfer
 	go func() {
+		defer done()
+		defer connDone()
 		defer sshTunnel.Close()
 		defer targetConn.Close()
 
-		_, err := io.Copy(sshTunnel, targetConn)
+		_, err := metrics.Copy(service, metrics.Out, sshTunnel, targetConn)
 		if err != nil {
 			log.Println("exporter:tunnel <- upstream: error: ", err)
 		}
@@ -193,9 +576,11 @@ func onNewConnectionForward(sshTunnel net.Conn, targetAddress string) {
 
 	// Start local -> remote data transfer
 	go func() {
+		defer done()
+		defer connDone()
 		defer sshTunnel.Close()
 		defer targetConn.Close()
-		_, err := io.Copy(targetConn, sshTunnel)
+		_, err := metrics.Copy(service, metrics.In, targetConn, sshTunnel)
 		if err != nil {
 			log.Println("exporter:tunnel -> upstream: error: ", err)
 		}
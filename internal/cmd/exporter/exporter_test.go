@@ -0,0 +1,171 @@
+package exporter
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func newTestHostKey(t *testing.T) ssh.PublicKey {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	importerKey := newTestHostKey(t)
+	otherKey := newTestHostKey(t)
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1443}
+
+	_, err := newHostKeyCallback(&cmd.ExporterConfig{})
+	assert.Error(t, err)
+
+	callback, err := newHostKeyCallback(&cmd.ExporterConfig{
+		ImporterHostKey: string(ssh.MarshalAuthorizedKey(importerKey)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, callback("127.0.0.1:1443", addr, importerKey))
+	assert.Error(t, callback("127.0.0.1:1443", addr, otherKey))
+}
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, name string, isCA bool, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if !isCA {
+		template.DNSNames = []string{name}
+	}
+	signer := &testCert{cert: template, key: key}
+	if parent != nil {
+		signer = parent
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer.cert, &key.PublicKey, signer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key}
+}
+
+func TestImporterVerifier(t *testing.T) {
+	ca := newTestCert(t, "ca", true, nil)
+	intermediate := newTestCert(t, "intermediate", true, ca)
+	importer := newTestCert(t, "importer", false, intermediate)
+	other := newTestCert(t, "other", false, intermediate)
+	untrusted := newTestCert(t, "importer", false, nil)
+	caPool := x509.NewCertPool()
+	caPool.AddCert(ca.cert)
+	chain := func(leaf *testCert) [][]byte {
+		return [][]byte{leaf.cert.Raw, intermediate.cert.Raw}
+	}
+
+	_, err := newImporterVerifier(&cmd.ExporterConfig{}, caPool)
+	assert.Error(t, err)
+
+	verify, err := newImporterVerifier(&cmd.ExporterConfig{ImporterIdentity: "importer"}, caPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, verify(chain(importer), nil))
+	assert.Error(t, verify(nil, nil))
+	assert.Error(t, verify([][]byte{importer.cert.Raw}, nil), "the intermediate is needed")
+	assert.Error(t, verify([][]byte{untrusted.cert.Raw}, nil))
+	err = verify(chain(other), nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "expected identity 'importer'")
+
+	verify, err = newImporterVerifier(&cmd.ExporterConfig{ImporterSPKIPin: cmd.SPKIPin(importer.cert)}, caPool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, verify(chain(importer), nil))
+	assert.Error(t, verify(chain(other), nil))
+}
+
+func TestSessionConfigChanged(t *testing.T) {
+	config := &cmd.ExporterConfig{
+		ImporterHostPort: "importer.example.com:443",
+		Cert:             "cert",
+		Proxies:          []cmd.ProxySpec{{KubeService: "db", KubePort: 5432, UpstreamHost: "db.local", UpstreamPort: 5432}},
+	}
+	changed := *config
+	changed.Cert = "renewed"
+	changed.Proxies = append(changed.Proxies, cmd.ProxySpec{KubeService: "web", KubePort: 80, UpstreamHost: "web.local", UpstreamPort: 80})
+	changed.ReverseProxies = []cmd.ReverseProxySpec{{KubeService: "postgres", KubePort: 5432}}
+	assert.False(t, sessionConfigChanged(config, &changed), "services and certificates are updated without reconnecting")
+
+	changed.ImporterHostPort = "importer.example.com:8443"
+	assert.True(t, sessionConfigChanged(config, &changed))
+}
+
+func TestDialImporterHandshakeCanceled(t *testing.T) {
+	// The importer accepts the connection but never answers the TLS handshake.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := dialImporter(ctx, &cmd.ExporterConfig{ImporterHostPort: listener.Addr().String()}, &tls.Config{ServerName: "importer"})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handshake did not stop when the context was canceled")
+	}
+}
@@ -0,0 +1,191 @@
+package exporter
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// dialFunc opens a raw network connection to the given address.
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// importerProxyURL returns the proxy that the exporter should use to reach the
+// importer.  The proxy from the config takes precedence, otherwise the standard
+// HTTPS_PROXY and NO_PROXY environment variables are used.  A nil URL means
+// the importer should be dialed directly.
+func importerProxyURL(config *cmd.ExporterConfig) (*url.URL, error) {
+	if config.ImporterProxy != "" {
+		proxyURL, err := url.Parse(config.ImporterProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url: %v", err)
+		}
+		return proxyURL, nil
+	}
+	return httpproxy.FromEnvironment().ProxyFunc()(&url.URL{Scheme: "https", Host: config.ImporterHostPort})
+}
+
+// importerDialer returns the function used to open the network connection to
+// the importer that the TLS or wss transport runs over.
+func importerDialer(config *cmd.ExporterConfig) (dialFunc, error) {
+	proxyURL, err := importerProxyURL(config)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		dialer := &net.Dialer{}
+		return dialer.DialContext, nil
+	}
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialHTTPProxy(ctx, proxyURL, addr)
+		}, nil
+	case "socks5":
+		return socks5Dialer(proxyURL)
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme '%s', expecting one of: http, https, socks5", proxyURL.Scheme)
+	}
+}
+
+// upstreamDialer returns the function used to connect to the upstream services
+// that are exported.  The udp services are rejected when they would have to go
+// through the UpstreamProxy since it only relays tcp connections.
+func upstreamDialer(config *cmd.ExporterConfig) (dialFunc, error) {
+	if config.UpstreamProxy == "" {
+		dialer := &net.Dialer{}
+		return dialer.DialContext, nil
+	}
+	for _, service := range config.Proxies {
+		if service.IsUDP() {
+			return nil, fmt.Errorf("udp service %s can not be reached through the upstream proxy, it only relays tcp connections", service.KubeService)
+		}
+	}
+	proxyURL, err := url.Parse(config.UpstreamProxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream proxy url: %v", err)
+	}
+	if proxyURL.Scheme != "socks5" {
+		return nil, fmt.Errorf("unsupported upstream proxy scheme '%s', expecting: socks5", proxyURL.Scheme)
+	}
+	dialProxy, err := socks5Dialer(proxyURL)
+	if err != nil {
+		return nil, err
+	}
+	direct := &net.Dialer{}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// unix sockets are local to the exporter, so they can't go through the proxy.
+		if network == "unix" {
+			return direct.DialContext(ctx, network, addr)
+		}
+		return dialProxy(ctx, network, addr)
+	}, nil
+}
+
+// socks5Dialer returns a dial function that connects through the SOCKS5 proxy
+// at the url.  Username/password authentication is used if the url holds user
+// credentials.
+func socks5Dialer(proxyURL *url.URL) (dialFunc, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "1080")
+	}
+	var auth *proxy.Auth
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		auth = &proxy.Auth{
+			User:     proxyURL.User.Username(),
+			Password: password,
+		}
+	}
+	dialer, err := proxy.SOCKS5("tcp", proxyAddr, auth, nil)
+	if err != nil {
+		return nil, err
+	}
+	contextDialer, ok := dialer.(interface {
+		DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("the socks5 dialer does not support contexts")
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		log.Println("exporter:dialing through socks5 proxy:", proxyAddr)
+		return contextDialer.DialContext(ctx, network, addr)
+	}, nil
+}
+
+// dialHTTPProxy opens a tunnel to addr through an HTTP CONNECT proxy.  Basic
+// authentication is used if the proxy url holds user credentials.
+func dialHTTPProxy(ctx context.Context, proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		if proxyURL.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "443")
+		} else {
+			proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+		}
+	}
+
+	log.Println("exporter:dialing through http proxy:", proxyAddr)
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(proxyURL.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	// Don't let a stuck proxy hang the exporter.
+	deadline := time.Now().Add(30 * time.Second)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", proxyAddr, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused to connect to %s: %s", proxyAddr, addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s sent unexpected data after the CONNECT response", proxyAddr)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
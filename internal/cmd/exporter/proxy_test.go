@@ -0,0 +1,296 @@
+package exporter
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+// startConnectProxy starts an in process HTTP CONNECT proxy that requires
+// basic authentication.
+func startConnectProxy(t *testing.T, user string, password string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+	go http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.Header.Get("Proxy-Authorization") != expected {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		go func() {
+			defer conn.Close()
+			defer upstream.Close()
+			io.Copy(upstream, conn)
+		}()
+		go func() {
+			defer conn.Close()
+			defer upstream.Close()
+			io.Copy(conn, upstream)
+		}()
+	}))
+	return listener
+}
+
+// startSocks5Proxy starts an in process SOCKS5 proxy that requires username/password
+// authentication.  It only implements what's needed to CONNECT to an address.
+func startSocks5Proxy(t *testing.T, user string, password string) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSocks5(conn, user, password)
+		}
+	}()
+	return listener
+}
+
+func serveSocks5(conn net.Conn, user string, password string) {
+	readBytes := func(n int) []byte {
+		data := make([]byte, n)
+		if _, err := io.ReadFull(conn, data); err != nil {
+			return nil
+		}
+		return data
+	}
+
+	// method negotiation: only offer username/password auth
+	header := readBytes(2)
+	if header == nil || readBytes(int(header[1])) == nil {
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{5, 2})
+
+	// username/password auth
+	header = readBytes(2)
+	if header == nil {
+		conn.Close()
+		return
+	}
+	u := readBytes(int(header[1]))
+	l := readBytes(1)
+	if u == nil || l == nil {
+		conn.Close()
+		return
+	}
+	p := readBytes(int(l[0]))
+	if string(u) != user || string(p) != password {
+		conn.Write([]byte{1, 1})
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{1, 0})
+
+	// connect request
+	header = readBytes(4)
+	if header == nil {
+		conn.Close()
+		return
+	}
+	host := ""
+	switch header[3] {
+	case 1:
+		host = net.IP(readBytes(4)).String()
+	case 3:
+		l = readBytes(1)
+		host = string(readBytes(int(l[0])))
+	default:
+		conn.Close()
+		return
+	}
+	port := binary.BigEndian.Uint16(readBytes(2))
+	upstream, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		conn.Close()
+		return
+	}
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	go func() {
+		defer conn.Close()
+		defer upstream.Close()
+		io.Copy(upstream, conn)
+	}()
+	go func() {
+		defer conn.Close()
+		defer upstream.Close()
+		io.Copy(conn, upstream)
+	}()
+}
+
+func startEchoServer(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+func TestDialThroughHTTPProxy(t *testing.T) {
+	assert := assert.New(t)
+	echo := startEchoServer(t)
+	defer echo.Close()
+	proxy := startConnectProxy(t, "bob", "secret")
+	defer proxy.Close()
+
+	dial, err := importerDialer(&cmd.ExporterConfig{
+		ImporterHostPort: echo.Addr().String(),
+		ImporterProxy:    "http://bob:secret@" + proxy.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dial(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello!"))
+	assert.NoError(err)
+	data := make([]byte, 6)
+	_, err = io.ReadFull(conn, data)
+	assert.NoError(err)
+	assert.Equal("hello!", string(data))
+
+	dial, err = importerDialer(&cmd.ExporterConfig{
+		ImporterHostPort: echo.Addr().String(),
+		ImporterProxy:    "http://bob:wrong@" + proxy.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = dial(context.Background(), "tcp", echo.Addr().String())
+	if assert.Error(err) {
+		assert.True(strings.Contains(err.Error(), "407"), err.Error())
+	}
+}
+
+func TestDialThroughSocks5Proxy(t *testing.T) {
+	assert := assert.New(t)
+	echo := startEchoServer(t)
+	defer echo.Close()
+	proxy := startSocks5Proxy(t, "bob", "secret")
+	defer proxy.Close()
+
+	// Both the importer and the upstream dials can go through a socks5 proxy.
+	importerDial, err := importerDialer(&cmd.ExporterConfig{
+		ImporterHostPort: echo.Addr().String(),
+		ImporterProxy:    "socks5://bob:secret@" + proxy.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstreamDial, err := upstreamDialer(&cmd.ExporterConfig{
+		UpstreamProxy: "socks5://bob:secret@" + proxy.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dial := range []dialFunc{importerDial, upstreamDial} {
+		conn, err := dial(context.Background(), "tcp", echo.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = conn.Write([]byte("hello!"))
+		assert.NoError(err)
+		data := make([]byte, 6)
+		_, err = io.ReadFull(conn, data)
+		assert.NoError(err)
+		assert.Equal("hello!", string(data))
+		conn.Close()
+	}
+
+	upstreamDial, err = upstreamDialer(&cmd.ExporterConfig{
+		UpstreamProxy: "socks5://bob:wrong@" + proxy.Addr().String(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = upstreamDial(context.Background(), "tcp", echo.Addr().String())
+	assert.Error(err)
+}
+
+func TestImporterProxyURLFromEnvironment(t *testing.T) {
+	assert := assert.New(t)
+	defer os.Unsetenv("HTTPS_PROXY")
+	defer os.Unsetenv("NO_PROXY")
+	os.Setenv("HTTPS_PROXY", "http://proxy.example.com:3128")
+	os.Setenv("NO_PROXY", "internal.example.com")
+
+	proxyURL, err := importerProxyURL(&cmd.ExporterConfig{ImporterHostPort: "importer.example.com:443"})
+	assert.NoError(err)
+	if assert.NotNil(proxyURL) {
+		assert.Equal("proxy.example.com:3128", proxyURL.Host)
+	}
+
+	proxyURL, err = importerProxyURL(&cmd.ExporterConfig{ImporterHostPort: "internal.example.com:443"})
+	assert.NoError(err)
+	assert.Nil(proxyURL)
+
+	proxyURL, err = importerProxyURL(&cmd.ExporterConfig{ImporterHostPort: "importer.example.com:443", ImporterProxy: "http://other.example.com:8080"})
+	assert.NoError(err)
+	if assert.NotNil(proxyURL) {
+		assert.Equal("other.example.com:8080", proxyURL.Host)
+	}
+}
+
+func TestUpstreamProxyRejectsUDPServices(t *testing.T) {
+	_, err := upstreamDialer(&cmd.ExporterConfig{
+		UpstreamProxy: "socks5://proxy.example.com:1080",
+		Proxies: []cmd.ProxySpec{
+			{KubeService: "web", KubePort: 80, UpstreamHost: "10.0.0.1", UpstreamPort: 80},
+			{Protocol: cmd.ProtocolUDP, KubeService: "dns", KubePort: 53, UpstreamHost: "10.0.0.1", UpstreamPort: 53},
+		},
+	})
+	assert.Error(t, err)
+
+	_, err = upstreamDialer(&cmd.ExporterConfig{
+		Proxies: []cmd.ProxySpec{{Protocol: cmd.ProtocolUDP, KubeService: "dns", KubePort: 53, UpstreamHost: "10.0.0.1", UpstreamPort: 53}},
+	})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,56 @@
+package exporter
+
+import (
+	"context"
+	"log"
+	"reflect"
+	"syscall"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+)
+
+// ServeConfigFile is Serve for the config in file.  Changes made to the file are
+// applied when it's modified or when the process receives a SIGHUP.
+func ServeConfigFile(ctx context.Context, file string) error {
+	config, err := LoadConfigFile(file)
+	if err != nil {
+		return err
+	}
+	reloads := make(chan *cmd.ExporterConfig)
+	reload := func() {
+		config, err := LoadConfigFile(file)
+		if err != nil {
+			log.Println("exporter:ignoring invalid config change:", err)
+			return
+		}
+		select {
+		case reloads <- config:
+		case <-ctx.Done():
+		}
+	}
+	go cmd.WatchFiles(ctx, func() []string { return []string{file} }, func() {
+		log.Println("exporter:config file changed:", file)
+		reload()
+	})
+	go cmd.OnSignal(ctx, func() {
+		log.Println("exporter:reloading the config file on SIGHUP:", file)
+		reload()
+	}, syscall.SIGHUP)
+	return serve(ctx, config, reloads)
+}
+
+// sessionConfigChanged reports if the config changed in a way that can only be
+// applied by reconnecting to the importer.  The Proxies and ReverseProxies are
+// updated over the established session and new certificates are used by the next
+// session.
+func sessionConfigChanged(previous *cmd.ExporterConfig, changed *cmd.ExporterConfig) bool {
+	strip := func(config *cmd.ExporterConfig) cmd.ExporterConfig {
+		result := *config
+		result.Proxies = nil
+		result.ReverseProxies = nil
+		result.Cert, result.Key, result.CAs = "", "", nil
+		result.DrainTimeout, result.MetricsListen, result.HealthListen = 0, "", ""
+		return result
+	}
+	return !reflect.DeepEqual(strip(previous), strip(changed))
+}
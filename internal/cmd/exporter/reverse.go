@@ -0,0 +1,144 @@
+package exporter
+
+import (
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/chirino/svcteleporter/internal/pkg/metrics"
+	"github.com/chirino/svcteleporter/internal/pkg/utils"
+	"golang.org/x/crypto/ssh"
+	"log"
+	"net"
+	"os"
+	"sync"
+)
+
+// reverseForwards accepts connections for the ReverseProxies of the exporter and
+// forwards them to the importer over direct-tcpip channels.  The listeners stay
+// open across sessions so that local clients keep a stable address to connect to.
+type reverseForwards struct {
+	sync.Mutex
+	client *ssh.Client
+	// listeners are keyed by the String() of their spec.
+	listeners map[string]net.Listener
+	// streams counts the forwarded connections.
+	streams *utils.Streams
+}
+
+// listenReverseProxies opens the local listeners of all the reverse proxies.
+func listenReverseProxies(specs []cmd.ReverseProxySpec, streams *utils.Streams) (*reverseForwards, error) {
+	r := &reverseForwards{listeners: map[string]net.Listener{}, streams: streams}
+	if err := r.update(specs); err != nil {
+		r.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// update closes the listeners of the reverse proxies that are no longer in specs
+// and opens the ones of the new specs.  The connections accepted by the closed
+// listeners are not affected.
+func (r *reverseForwards) update(specs []cmd.ReverseProxySpec) error {
+	r.Lock()
+	defer r.Unlock()
+	keep := map[string]bool{}
+	for _, spec := range specs {
+		keep[spec.String()] = true
+	}
+	for key, ln := range r.listeners {
+		if !keep[key] {
+			log.Println("exporter:closing listener of reverse proxy:", key)
+			ln.Close()
+			delete(r.listeners, key)
+		}
+	}
+	for _, spec := range specs {
+		if _, ok := r.listeners[spec.String()]; ok {
+			continue
+		}
+		network, address := spec.ListenAddress()
+		if network == "unix" {
+			if info, err := os.Lstat(address); err == nil && info.Mode()&os.ModeSocket != 0 {
+				os.Remove(address)
+			}
+		}
+		ln, err := net.Listen(network, address)
+		if err != nil {
+			return err
+		}
+		log.Println("exporter:listening for cluster service", spec.Target(), "on", address)
+		r.listeners[spec.String()] = ln
+		go r.serve(ln, spec.KubeService, spec.Target())
+	}
+	return nil
+}
+
+// setClient sets the ssh session that new connections get forwarded over.  It's
+// nil while there is no session to the importer.
+func (r *reverseForwards) setClient(client *ssh.Client) {
+	r.Lock()
+	r.client = client
+	r.Unlock()
+}
+
+func (r *reverseForwards) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	for _, ln := range r.listeners {
+		ln.Close()
+	}
+	return nil
+}
+
+// serve forwards the connections accepted by the listener to the target.  They
+// are counted in the metrics of the cluster service.
+func (r *reverseForwards) serve(ln net.Listener, service string, target string) {
+	for {
+		localConn, err := ln.Accept()
+		if err != nil {
+			log.Println("exporter:accept error", err)
+			return
+		}
+		r.Lock()
+		client := r.client
+		r.Unlock()
+		if client == nil {
+			log.Println("exporter:no session to importer, rejecting connection for cluster service:", target)
+			localConn.Close()
+			continue
+		}
+		done := r.streams.Add()
+		connDone := metrics.Connection(service)
+		go func() {
+			log.Println("exporter:tunnel dialing cluster service:", target)
+			sshTunnel, err := client.Dial("tcp", target)
+			if err != nil {
+				log.Println("exporter:tunnel dial error:", err)
+				localConn.Close()
+				connDone()
+				done()
+				return
+			}
+			go func() {
+				defer done()
+				defer connDone()
+				defer sshTunnel.Close()
+				defer localConn.Close()
+				_, err := metrics.Copy(service, metrics.In, sshTunnel, localConn)
+				if err != nil {
+					log.Println("exporter:local -> tunnel: error: ", err)
+				}
+				log.Println("exporter:local -> tunnel: closed")
+			}()
+			go func() {
+				defer done()
+				defer connDone()
+				defer sshTunnel.Close()
+				defer localConn.Close()
+				_, err := metrics.Copy(service, metrics.Out, localConn, sshTunnel)
+				if err != nil {
+					log.Println("exporter:local <- tunnel: error: ", err)
+				}
+				log.Println("exporter:local <- tunnel: closed")
+			}()
+		}()
+	}
+}
@@ -0,0 +1,238 @@
+package exporter
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/chirino/svcteleporter/internal/pkg/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// exportedServices are the Proxies that the exporter publishes through the
+// importer.  They can change while a session runs: the forwards of the added
+// services are requested and the ones of the removed services are canceled.
+type exportedServices struct {
+	sync.Mutex
+	proxies []cmd.ProxySpec
+	client  *ssh.Client
+	// forwarded holds the names of the services the importer accepted the forward
+	// of in the current session.
+	forwarded map[string]bool
+}
+
+func newExportedServices(proxies []cmd.ProxySpec) *exportedServices {
+	return &exportedServices{proxies: proxies, forwarded: map[string]bool{}}
+}
+
+// ready reports if the session is established and the service is forwarded, or
+// all of them when service is empty.
+func (s *exportedServices) ready(service string) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.client == nil {
+		return fmt.Errorf("no session to the importer")
+	}
+	if service != "" {
+		if !hasService(s.proxies, service) {
+			return fmt.Errorf("unknown service: %s", service)
+		}
+		if !s.forwarded[service] {
+			return fmt.Errorf("service %s is not forwarded", service)
+		}
+		return nil
+	}
+	for _, service := range s.proxies {
+		if !s.forwarded[service.KubeService] {
+			return fmt.Errorf("service %s is not forwarded", service.KubeService)
+		}
+	}
+	return nil
+}
+
+// lookup finds the service with the given name.
+func (s *exportedServices) lookup(name string) (cmd.ProxySpec, bool) {
+	s.Lock()
+	defer s.Unlock()
+	for _, service := range s.proxies {
+		if service.KubeService == name {
+			return service, true
+		}
+	}
+	return cmd.ProxySpec{}, false
+}
+
+// register requests the forwards of all the services over a new session.  The
+// lock is not held while waiting for the importer, the services added meanwhile
+// get requested too.
+func (s *exportedServices) register(client *ssh.Client) error {
+	requested := map[string]bool{}
+	for {
+		s.Lock()
+		pending := []cmd.ProxySpec{}
+		for _, service := range s.proxies {
+			if !requested[service.KubeService] {
+				pending = append(pending, service)
+			}
+		}
+		if len(pending) == 0 {
+			stale := []string{}
+			for name := range requested {
+				if hasService(s.proxies, name) {
+					s.forwarded[name] = true
+				} else {
+					stale = append(stale, name)
+				}
+			}
+			s.client = client
+			s.Unlock()
+			// The services removed while they were requested.
+			for _, name := range stale {
+				if err := cancelForward(client, name); err != nil {
+					log.Println("exporter:could not cancel the forward of service", name, ":", err)
+				}
+			}
+			return nil
+		}
+		s.Unlock()
+		for _, service := range pending {
+			if err := requestForward(client, service); err != nil {
+				return err
+			}
+			requested[service.KubeService] = true
+		}
+	}
+}
+
+// unregister is called once the session is lost.
+func (s *exportedServices) unregister() {
+	s.Lock()
+	s.client = nil
+	s.forwarded = map[string]bool{}
+	s.Unlock()
+}
+
+// update switches to the proxies.  Services that only changed their upstream keep
+// their forward, so their established connections are not affected.  The lock is
+// not held while waiting for the importer.
+func (s *exportedServices) update(proxies []cmd.ProxySpec) {
+	s.Lock()
+	previous := s.proxies
+	s.proxies = proxies
+	client := s.client
+	removed := []string{}
+	added := []cmd.ProxySpec{}
+	if client != nil {
+		for _, service := range previous {
+			if !hasService(proxies, service.KubeService) {
+				removed = append(removed, service.KubeService)
+				delete(s.forwarded, service.KubeService)
+			}
+		}
+		for _, service := range proxies {
+			if !hasService(previous, service.KubeService) {
+				added = append(added, service)
+			}
+		}
+	}
+	s.Unlock()
+
+	for _, name := range removed {
+		if err := cancelForward(client, name); err != nil {
+			log.Println("exporter:could not cancel the forward of service", name, ":", err)
+		}
+	}
+	for _, service := range added {
+		// The other services stay exported, the service gets requested again on the
+		// next session if the importer does not know about it yet.
+		if err := requestForward(client, service); err != nil {
+			log.Println("exporter:could not export service", service.KubeService, ":", err)
+			continue
+		}
+		s.Lock()
+		if s.client == client && hasService(s.proxies, service.KubeService) {
+			s.forwarded[service.KubeService] = true
+		}
+		s.Unlock()
+	}
+}
+
+// cancel cancels the forwards of all the services so that the importer stops
+// accepting connections for them.  It's used on shutdown, so it does not wait for
+// the importer to answer.
+func (s *exportedServices) cancel() {
+	s.Lock()
+	client := s.client
+	proxies := s.proxies
+	s.forwarded = map[string]bool{}
+	s.Unlock()
+	if client == nil {
+		return
+	}
+	for _, service := range proxies {
+		if err := cancelForward(client, service.KubeService); err != nil {
+			log.Println("exporter:could not cancel the forward of service", service.KubeService, ":", err)
+		}
+	}
+}
+
+// handleRequests handles the ServiceForwardClosedRequest of the importer and
+// passes the other global requests of the session on.
+func (s *exportedServices) handleRequests(in <-chan *ssh.Request) <-chan *ssh.Request {
+	out := make(chan *ssh.Request)
+	go func() {
+		defer close(out)
+		for req := range in {
+			if req.Type != protocol.ServiceForwardClosedRequest {
+				out <- req
+				continue
+			}
+			payload := protocol.ServiceForward{}
+			if err := ssh.Unmarshal(req.Payload, &payload); err == nil {
+				log.Println("exporter:importer closed the forward of service", payload.Service)
+				s.Lock()
+				delete(s.forwarded, payload.Service)
+				s.Unlock()
+			}
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}()
+	return out
+}
+
+func hasService(proxies []cmd.ProxySpec, name string) bool {
+	for _, service := range proxies {
+		if service.KubeService == name {
+			return true
+		}
+	}
+	return false
+}
+
+func requestForward(client *ssh.Client, service cmd.ProxySpec) error {
+	_, upstream := upstreamAddress(service)
+	log.Println("exporter:requesting forward of service", service.KubeService, "to", upstream)
+	ok, reply, err := client.SendRequest(protocol.ServiceForwardRequest, true, ssh.Marshal(&protocol.ServiceForward{
+		Service: service.KubeService,
+	}))
+	if err != nil {
+		return fmt.Errorf("export error: %s", err)
+	}
+	if !ok {
+		return fmt.Errorf("importer rejected service %s: %s", service.KubeService, string(reply))
+	}
+	return nil
+}
+
+// cancelForward asks the importer to stop accepting connections for the service.
+// It does not wait for the answer, the importer closes the listener either way.
+func cancelForward(client *ssh.Client, name string) error {
+	log.Println("exporter:canceling forward of service", name)
+	_, _, err := client.SendRequest(protocol.CancelServiceForwardRequest, false, ssh.Marshal(&protocol.ServiceForward{
+		Service: name,
+	}))
+	return err
+}
@@ -0,0 +1,83 @@
+package exporter
+
+import (
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// unresponsiveImporter returns a client of an ssh server that never answers the
+// global requests.
+func unresponsiveImporter(t *testing.T) *ssh.Client {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig := &ssh.ServerConfig{NoClientAuth: true}
+	serverConfig.AddHostKey(signer)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer listener.Close()
+		serverSide, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_, chans, reqs, err := ssh.NewServerConn(serverSide, serverConfig)
+		if err != nil {
+			return
+		}
+		go func() {
+			for range chans {
+			}
+		}()
+		// Never reply to the requests.
+		for range reqs {
+		}
+	}()
+	clientSide, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, chans, reqs, err := ssh.NewClientConn(clientSide, "importer", &ssh.ClientConfig{HostKeyCallback: ssh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ssh.NewClient(c, chans, reqs)
+}
+
+func TestServicesDoNotWaitForUnresponsiveImporter(t *testing.T) {
+	client := unresponsiveImporter(t)
+	defer client.Close()
+	a := cmd.ProxySpec{KubeService: "a", KubePort: 80, UpstreamHost: "127.0.0.1", UpstreamPort: 8080}
+	services := newExportedServices(nil)
+	services.client = client
+
+	// The forward of the added service is never answered.
+	go services.update([]cmd.ProxySpec{a})
+	time.Sleep(100 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		assert.Error(t, services.ready(""))
+		services.cancel()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the readiness and the shutdown should not wait for the importer")
+	}
+}
@@ -0,0 +1,86 @@
+package exporter
+
+import (
+	"log"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/chirino/svcteleporter/internal/pkg/metrics"
+	"github.com/chirino/svcteleporter/internal/pkg/protocol"
+	"github.com/chirino/svcteleporter/internal/pkg/utils"
+	"golang.org/x/crypto/ssh"
+)
+
+// onNewDatagramForward relays the datagrams framed on the ssh channel to the
+// upstream udp service and the replies back.  The session is closed once no
+// datagrams flow in either direction for the idle timeout.  It's counted in streams
+// until it closes, and in the metrics of the service.
+func onNewDatagramForward(sshTunnel ssh.Channel, service string, targetAddress string, idleTimeout time.Duration, streams *utils.Streams) {
+	done := streams.Add()
+	log.Println("exporter:udp tunnel dialing upstream:", targetAddress)
+	started := time.Now()
+	targetConn, err := net.Dial("udp", targetAddress)
+	metrics.UpstreamDial(service, started, err)
+	if err != nil {
+		done()
+		sshTunnel.Close()
+		log.Println("exporter:udp tunnel dial error:", err)
+		return
+	}
+	connDone := metrics.Connection(service)
+
+	lastActive := time.Now().UnixNano()
+	touch := func() {
+		atomic.StoreInt64(&lastActive, time.Now().UnixNano())
+	}
+
+	// Start upstream -> tunnel datagram transfer
+	go func() {
+		defer done()
+		defer connDone()
+		defer sshTunnel.Close()
+		defer targetConn.Close()
+		buf := make([]byte, protocol.MaxDatagramSize)
+		for {
+			targetConn.SetReadDeadline(time.Unix(0, atomic.LoadInt64(&lastActive)).Add(idleTimeout))
+			n, err := targetConn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					if time.Since(time.Unix(0, atomic.LoadInt64(&lastActive))) < idleTimeout {
+						continue
+					}
+					log.Println("exporter:udp tunnel idle, closing:", targetAddress)
+					return
+				}
+				log.Println("exporter:udp tunnel <- upstream: error: ", err)
+				return
+			}
+			touch()
+			if err := protocol.WriteDatagram(sshTunnel, buf[:n]); err != nil {
+				return
+			}
+			metrics.Relayed(service, metrics.Out, n)
+		}
+	}()
+
+	// Start tunnel -> upstream datagram transfer
+	go func() {
+		defer done()
+		defer connDone()
+		defer sshTunnel.Close()
+		defer targetConn.Close()
+		buf := make([]byte, protocol.MaxDatagramSize)
+		for {
+			n, err := protocol.ReadDatagram(sshTunnel, buf)
+			if err != nil {
+				log.Println("exporter:udp tunnel -> upstream: closed")
+				return
+			}
+			touch()
+			if n, err := targetConn.Write(buf[:n]); err == nil {
+				metrics.Relayed(service, metrics.In, n)
+			}
+		}
+	}()
+}
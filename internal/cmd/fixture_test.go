@@ -0,0 +1,188 @@
+package cmd_test
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/chirino/svcteleporter/internal/cmd/exporter"
+	"github.com/chirino/svcteleporter/internal/cmd/importer"
+	"github.com/chirino/svcteleporter/internal/cmd/install"
+	"github.com/chirino/svcteleporter/internal/pkg/pki"
+)
+
+func TestMain(m *testing.M) {
+	// Poll the config files often so that the reload tests run quickly.  It's set
+	// once, before the importers and exporters of the tests start watching.
+	cmd.ConfigPollInterval = 100 * time.Millisecond
+	os.Exit(m.Run())
+}
+
+// runningImporter is the part of the importer the tests drive.
+type runningImporter interface {
+	Serve(listener net.Listener) error
+	Reload(config *cmd.ImporterConfig) error
+	Ready(service string) error
+}
+
+// fixture holds the standalone configs of an importer and an exporter generated by
+// install in a temporary directory, and the tunnel listener the importer serves on.
+type fixture struct {
+	t              *testing.T
+	dir            string
+	Tunnel         net.Listener
+	ImporterFile   string
+	ExporterFile   string
+	ImporterConfig *cmd.ImporterConfig
+	ExporterConfig *cmd.ExporterConfig
+}
+
+// newFixture installs the configs for the options.  The importer host port, the
+// output kinds and the files are filled in, the transport, key type and duration
+// default to tls, ecdsa-p256 and an hour.
+func newFixture(t *testing.T, options install.Options) *fixture {
+	dir, err := ioutil.TempDir("", "svcteleporter")
+	FatalOnError(t, err)
+	f := &fixture{t: t, dir: dir}
+	f.Tunnel, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		f.Close()
+		t.Fatal(err)
+	}
+
+	prefix := filepath.Join(dir, "test-")
+	options.Kinds = []string{"standalone"}
+	options.Prefix = prefix
+	options.CAFile = prefix + "ca.yaml"
+	options.ImporterHostPort = f.Tunnel.Addr().String()
+	if options.Transport == "" {
+		options.Transport = cmd.TransportTLS
+	}
+	if options.KeyType == "" {
+		options.KeyType = pki.KeyTypeECDSAP256
+	}
+	if options.Duration == 0 {
+		options.Duration = time.Hour
+	}
+	f.ImporterFile = prefix + "standalone-importer.yaml"
+	f.ExporterFile = prefix + "standalone-exporter.yaml"
+	if err := install.ConfigFiles(options); err != nil {
+		f.Close()
+		t.Fatal(err)
+	}
+	if f.ImporterConfig, err = importer.LoadConfigFile(f.ImporterFile); err != nil {
+		f.Close()
+		t.Fatal(err)
+	}
+	if f.ExporterConfig, err = exporter.LoadConfigFile(f.ExporterFile); err != nil {
+		f.Close()
+		t.Fatal(err)
+	}
+	return f
+}
+
+func (f *fixture) Close() {
+	if f.Tunnel != nil {
+		f.Tunnel.Close()
+	}
+	os.RemoveAll(f.dir)
+}
+
+// startImporter serves the ImporterConfig on the tunnel listener until the context
+// is canceled.  The result of Serve is sent to the returned channel.
+func (f *fixture) startImporter(ctx context.Context) (runningImporter, <-chan error) {
+	return f.startImporterOn(ctx, f.Tunnel)
+}
+
+// startImporterOn is startImporter for another listener, like one opened again
+// on the tunnel address after the previous importer stopped.
+func (f *fixture) startImporterOn(ctx context.Context, listener net.Listener) (runningImporter, <-chan error) {
+	imp, err := importer.NewFromConfig(ctx, f.ImporterConfig)
+	FatalOnError(f.t, err)
+	done := make(chan error, 1)
+	go func() { done <- imp.Serve(listener) }()
+	return imp, done
+}
+
+// startExporter serves the ExporterConfig until the context is canceled.  The
+// result of Serve is sent to the returned channel.
+func (f *fixture) startExporter(ctx context.Context) <-chan error {
+	done := make(chan error, 1)
+	go func(config *cmd.ExporterConfig) { done <- exporter.Serve(ctx, config) }(f.ExporterConfig)
+	return done
+}
+
+// echoService answers every connection by echoing back what it receives.
+func echoService(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	FatalOnError(t, err)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener
+}
+
+// echoProxy is the spec of a service that the importer listens for on a free
+// local port and that the exporter forwards to the upstream listener.
+func echoProxy(t *testing.T, name string, upstream net.Listener) cmd.ProxySpec {
+	port, err := strconv.Atoi(getPort(upstream))
+	FatalOnError(t, err)
+	return cmd.ProxySpec{KubeService: name, KubePort: 80, ListenHost: "127.0.0.1", ListenPort: freePort(t), UpstreamHost: "127.0.0.1", UpstreamPort: uint32(port)}
+}
+
+// address is where the importer listens for the service.
+func address(service cmd.ProxySpec) string {
+	return net.JoinHostPort(service.ListenHost, strconv.Itoa(int(service.ListenPort)))
+}
+
+func freePort(t *testing.T) uint32 {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	FatalOnError(t, err)
+	defer listener.Close()
+	port, err := strconv.Atoi(getPort(listener))
+	FatalOnError(t, err)
+	return uint32(port)
+}
+
+// dialEcho connects to the echo service through the address, retrying until the
+// forward is in place.
+func dialEcho(t *testing.T, address string) net.Conn {
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", address)
+		if err == nil {
+			if echoes(conn, "ping") {
+				return conn
+			}
+			conn.Close()
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("could not reach the service at", address)
+	return nil
+}
+
+func echoes(conn net.Conn, message string) bool {
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write([]byte(message)); err != nil {
+		return false
+	}
+	reply := make([]byte, len(message))
+	_, err := io.ReadFull(conn, reply)
+	return err == nil && string(reply) == message
+}
@@ -0,0 +1,74 @@
+package cmd_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/chirino/svcteleporter/internal/cmd/install"
+	"github.com/stretchr/testify/assert"
+)
+
+func probe(t *testing.T, url string) int {
+	response, err := http.Get(url)
+	FatalOnError(t, err)
+	response.Body.Close()
+	return response.StatusCode
+}
+
+// waitForProbe polls the url until it answers with the status code.
+func waitForProbe(t *testing.T, url string, status int) {
+	for i := 0; i < 50; i++ {
+		response, err := http.Get(url)
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode == status {
+				return
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal(url, "did not answer with status", status)
+}
+
+func TestHealthProbes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	upstream := echoService(t)
+	defer upstream.Close()
+	a := echoProxy(t, "a", upstream)
+	b := echoProxy(t, "b", upstream)
+	f := newFixture(t, install.Options{Proxies: []cmd.ProxySpec{a, b}})
+	defer f.Close()
+
+	f.ImporterConfig.HealthListen = fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	f.ImporterConfig.MetricsListen = f.ImporterConfig.HealthListen
+	f.startImporter(ctx)
+	importerURL := "http://" + f.ImporterConfig.HealthListen
+
+	waitForProbe(t, importerURL+"/healthz", http.StatusOK)
+	assert.Equal(t, http.StatusServiceUnavailable, probe(t, importerURL+"/readyz"), "the importer is not ready until an exporter holds a service")
+	assert.Equal(t, http.StatusServiceUnavailable, probe(t, importerURL+"/readyz/a"), "no exporter holds the service yet")
+	assert.Equal(t, http.StatusOK, probe(t, importerURL+"/metrics"))
+
+	// Only the exporter of service a is connected.
+	f.ExporterConfig.Proxies = []cmd.ProxySpec{a}
+	f.ExporterConfig.HealthListen = fmt.Sprintf("127.0.0.1:%d", freePort(t))
+	f.startExporter(ctx)
+	exporterURL := "http://" + f.ExporterConfig.HealthListen
+
+	waitForProbe(t, exporterURL+"/readyz", http.StatusOK)
+	assert.Equal(t, http.StatusOK, probe(t, exporterURL+"/healthz"))
+	assert.Equal(t, http.StatusOK, probe(t, exporterURL+"/readyz/a"))
+	assert.Equal(t, http.StatusServiceUnavailable, probe(t, exporterURL+"/readyz/unknown"))
+	waitForProbe(t, importerURL+"/readyz/a", http.StatusOK)
+	assert.Equal(t, http.StatusOK, probe(t, importerURL+"/readyz"), "the importer is ready once an exporter holds a service")
+	assert.Equal(t, http.StatusServiceUnavailable, probe(t, importerURL+"/readyz/b"))
+	assert.Equal(t, http.StatusOK, probe(t, importerURL+"/readyz"), "the missing exporter of service b should not take down service a")
+	conn := dialEcho(t, address(a))
+	conn.Close()
+}
@@ -0,0 +1,54 @@
+package importer
+
+import (
+	"crypto/x509"
+	"fmt"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+)
+
+// authorizations maps exporter identities to the services they can publish.  A
+// nil authorizations lets every exporter publish every service.
+type authorizations []cmd.Authorization
+
+func newAuthorizations(config *cmd.ImporterConfig) (authorizations, error) {
+	services := map[string]bool{}
+	for _, service := range config.Services {
+		services[service.KubeService] = true
+	}
+	for _, authorization := range config.Authorizations {
+		if authorization.Identity == "" {
+			return nil, fmt.Errorf("authorization is missing an identity")
+		}
+		for _, service := range authorization.Services {
+			if service != "*" && !services[service] {
+				return nil, fmt.Errorf("authorization of %s refers to unknown service: %s", authorization.Identity, service)
+			}
+		}
+	}
+	if len(config.Authorizations) == 0 {
+		return nil, nil
+	}
+	return authorizations(config.Authorizations), nil
+}
+
+// allows reports if the exporter holding cert may publish the service.
+func (a authorizations) allows(cert *x509.Certificate, service string) bool {
+	if a == nil {
+		return true
+	}
+	if cert == nil {
+		return false
+	}
+	for _, authorization := range a {
+		if !cmd.CertHasIdentity(cert, authorization.Identity) {
+			continue
+		}
+		for _, allowed := range authorization.Services {
+			if allowed == "*" || allowed == service {
+				return true
+			}
+		}
+	}
+	return false
+}
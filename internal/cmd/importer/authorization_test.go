@@ -0,0 +1,46 @@
+package importer
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorizations(t *testing.T) {
+	config := &cmd.ImporterConfig{
+		Services: []cmd.ProxySpec{
+			{KubeService: "db", KubePort: 5432},
+			{KubeService: "web", KubePort: 80},
+		},
+	}
+	auth, err := newAuthorizations(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, auth.allows(nil, "db"), "everything is allowed without authorizations")
+
+	config.Authorizations = []cmd.Authorization{
+		{Identity: "team-a", Services: []string{"db"}},
+		{Identity: "admin.example.com", Services: []string{"*"}},
+	}
+	auth, err = newAuthorizations(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	teamA := &x509.Certificate{Subject: pkix.Name{CommonName: "team-a"}}
+	teamB := &x509.Certificate{Subject: pkix.Name{CommonName: "team-b"}}
+	admin := &x509.Certificate{Subject: pkix.Name{CommonName: "admin"}, DNSNames: []string{"admin.example.com"}}
+
+	assert.True(t, auth.allows(teamA, "db"))
+	assert.False(t, auth.allows(teamA, "web"))
+	assert.False(t, auth.allows(teamB, "db"))
+	assert.True(t, auth.allows(admin, "web"))
+	assert.False(t, auth.allows(nil, "db"))
+
+	config.Authorizations = []cmd.Authorization{{Identity: "team-a", Services: []string{"dbs"}}}
+	_, err = newAuthorizations(config)
+	assert.Error(t, err)
+}
@@ -0,0 +1,74 @@
+package importer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chirino/svcteleporter/internal/pkg/metrics"
+	"github.com/chirino/svcteleporter/internal/pkg/pki"
+	"github.com/stretchr/testify/assert"
+)
+
+func handshakeFailures(t *testing.T) float64 {
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == "svcteleporter_tls_handshake_failures_total" {
+			return family.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestHandshakingListener(t *testing.T) {
+	ca, err := pki.NewCA(pki.KeyTypeECDSAP256, 0, time.Hour, "test-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err := ca.Issue(pki.KeyTypeECDSAP256, 0, time.Hour, "importer", x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newHandshakingListener(tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}}))
+	defer l.Close()
+	failures := handshakeFailures(t)
+
+	// A client that does not speak TLS fails the handshake and is never accepted.
+	plain, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.Write([]byte("GET / HTTP/1.0\r\n\r\n"))
+	defer plain.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	client, err := tls.Dial("tcp", listener.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assert.Equal(t, client.LocalAddr().String(), conn.RemoteAddr().String())
+	assert.Equal(t, failures+1, handshakeFailures(t))
+
+	listener.Close()
+	_, err = l.Accept()
+	assert.Error(t, err)
+}
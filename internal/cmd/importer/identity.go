@@ -0,0 +1,79 @@
+package importer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+
+	"github.com/chirino/ssh"
+)
+
+// peerAddr is the remote address of an exporter connection annotated with the
+// client certificate the exporter authenticated with.  The ssh server exposes it
+// to the callbacks through ssh.Context.RemoteAddr().
+type peerAddr struct {
+	net.Addr
+	Cert *x509.Certificate
+}
+
+type identifiedConn struct {
+	net.Conn
+	remoteAddr *peerAddr
+}
+
+func (c *identifiedConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// identify annotates the connection with the client certificate of its TLS
+// session.  conn is either a TLS connection or a web socket running over one.
+func identify(conn net.Conn) (net.Conn, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		if ws, ok := conn.(interface{ UnderlyingConn() net.Conn }); ok {
+			tlsConn, _ = ws.UnderlyingConn().(*tls.Conn)
+		}
+	}
+	addr := &peerAddr{Addr: conn.RemoteAddr()}
+	if tlsConn != nil {
+		if err := tlsConn.Handshake(); err != nil {
+			return nil, err
+		}
+		if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+			addr.Cert = certs[0]
+		}
+	}
+	return &identifiedConn{Conn: conn, remoteAddr: addr}, nil
+}
+
+// certIdentity names the holder of a certificate by its common name, falling
+// back to its first DNS name.
+func certIdentity(cert *x509.Certificate) string {
+	if cert == nil {
+		return "unknown"
+	}
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0]
+	}
+	return cert.Subject.String()
+}
+
+// peerCert returns the client certificate of the exporter of an ssh connection.
+func peerCert(ctx ssh.Context) *x509.Certificate {
+	if addr, ok := ctx.RemoteAddr().(*peerAddr); ok {
+		return addr.Cert
+	}
+	return nil
+}
+
+// peerIdentity returns the certificate identity of the exporter of an ssh
+// connection.
+func peerIdentity(ctx ssh.Context) string {
+	if addr, ok := ctx.RemoteAddr().(*peerAddr); ok {
+		return certIdentity(addr.Cert) + "@" + addr.String()
+	}
+	return certIdentity(nil) + "@" + ctx.RemoteAddr().String()
+}
@@ -0,0 +1,109 @@
+package importer
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/chirino/svcteleporter/internal/cmd/install"
+	"github.com/chirino/svcteleporter/internal/pkg/pki"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReloadTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svcteleporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configs := []*cmd.ImporterConfig{}
+	for _, prefix := range []string{"a-", "b-"} {
+		err = install.ConfigFiles(install.Options{
+			Kinds:    []string{"standalone"},
+			Duration: time.Hour,
+			KeyType:  pki.KeyTypeECDSAP256,
+			Prefix:   filepath.Join(dir, prefix),
+			Proxies:  []cmd.ProxySpec{{KubeService: "db", KubePort: 5432, UpstreamHost: "db.local", UpstreamPort: 5432}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		config, err := LoadConfigFile(filepath.Join(dir, prefix+"standalone-importer.yaml"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		configs = append(configs, config)
+	}
+
+	importer, err := NewFromConfig(context.Background(), configs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := func() *tls.Config {
+		config, err := importer.TLSConfig.GetConfigForClient(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config
+	}
+	first := current().Certificates[0].Certificate[0]
+
+	assert.NoError(t, importer.ReloadTLS(configs[1]))
+	assert.NotEqual(t, first, current().Certificates[0].Certificate[0])
+
+	assert.Error(t, importer.ReloadTLS(&cmd.ImporterConfig{Cert: "invalid"}))
+	assert.NotEqual(t, first, current().Certificates[0].Certificate[0], "a failed reload keeps the current config")
+}
+
+func TestReloadTLSFromSecretDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svcteleporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca, err := pki.NewCA(pki.KeyTypeECDSAP256, 0, time.Hour, "test-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeSecret := func() *tls.Certificate {
+		cert, key, err := ca.Issue(pki.KeyTypeECDSAP256, 0, time.Hour, "importer", x509.ExtKeyUsageServerAuth)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, data := range map[string]string{cmd.TLSCertFile: cert, cmd.TLSKeyFile: key, cmd.CACertFile: ca.CertPEM} {
+			if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		pair, err := tls.X509KeyPair([]byte(cert), []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &pair
+	}
+
+	first := writeSecret()
+	config := &cmd.ImporterConfig{Cert: "file:" + dir, Key: "file:" + dir, CAs: []string{"file:" + dir}}
+	importer, err := NewFromConfig(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current := func() []byte {
+		config, err := importer.TLSConfig.GetConfigForClient(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return config.Certificates[0].Certificate[0]
+	}
+	assert.Equal(t, first.Certificate[0], current())
+
+	second := writeSecret()
+	assert.NoError(t, importer.ReloadTLS(config))
+	assert.Equal(t, second.Certificate[0], current())
+}
@@ -0,0 +1,102 @@
+package importer
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/chirino/ssh"
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/chirino/svcteleporter/internal/pkg/utils"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// keepAlives sends keepalives to every connected exporter from the moment its ssh
+// handshake completes, so that the exporters that never send a request are probed
+// too.  The ssh server does not have a callback for that moment, so the connection
+// is watched instead: the authentication log tells which ssh connection runs over
+// it, and the ssh server reads the connection's local address once the handshake
+// completes, to fill in the ssh.Context.
+type keepAlives struct {
+	sync.Mutex
+	spec  *cmd.KeepAliveSpec
+	conns map[net.Addr]*keepAliveConn
+}
+
+func newKeepAlives(spec *cmd.KeepAliveSpec) *keepAlives {
+	return &keepAlives{
+		spec:  spec,
+		conns: map[net.Addr]*keepAliveConn{},
+	}
+}
+
+// watch is the ssh.ConnCallback that tracks a connection until its handshake completes.
+func (k *keepAlives) watch(conn net.Conn) net.Conn {
+	if !k.spec.Enabled() {
+		return conn
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &keepAliveConn{Conn: conn, keepAlives: k, ctx: ctx, cancel: cancel}
+	k.Lock()
+	k.conns[conn.RemoteAddr()] = c
+	k.Unlock()
+	return c
+}
+
+// serverConfig is the ssh.ServerConfigCallback that records the ssh connection of
+// the exporters that authenticate.
+func (k *keepAlives) serverConfig(ctx ssh.Context) *gossh.ServerConfig {
+	return &gossh.ServerConfig{
+		AuthLogCallback: func(meta gossh.ConnMetadata, method string, err error) {
+			if err != nil {
+				return
+			}
+			k.Lock()
+			defer k.Unlock()
+			if c, ok := k.conns[meta.RemoteAddr()]; ok {
+				c.sshConn, _ = meta.(gossh.Conn)
+			}
+		},
+	}
+}
+
+// HandleSSHRequest answers the keepalives sent by the exporter.
+func (k *keepAlives) HandleSSHRequest(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
+	return true, nil
+}
+
+// start starts the keepalives of an authenticated connection.
+func (k *keepAlives) start(c *keepAliveConn) {
+	k.Lock()
+	defer k.Unlock()
+	if c.sshConn == nil || c.started {
+		return
+	}
+	c.started = true
+	delete(k.conns, c.Conn.RemoteAddr())
+	go utils.KeepAlive(c.ctx, c.sshConn, k.spec.IntervalOrDefault(), k.spec.MaxMissedOrDefault(), "importer:")
+}
+
+// keepAliveConn is an exporter connection that starts its keepalives once the ssh
+// handshake completes, and stops them when it is closed.
+type keepAliveConn struct {
+	net.Conn
+	keepAlives *keepAlives
+	ctx        context.Context
+	cancel     context.CancelFunc
+	sshConn    gossh.Conn
+	started    bool
+}
+
+func (c *keepAliveConn) LocalAddr() net.Addr {
+	c.keepAlives.start(c)
+	return c.Conn.LocalAddr()
+}
+
+func (c *keepAliveConn) Close() error {
+	c.cancel()
+	c.keepAlives.Lock()
+	delete(c.keepAlives.conns, c.Conn.RemoteAddr())
+	c.keepAlives.Unlock()
+	return c.Conn.Close()
+}
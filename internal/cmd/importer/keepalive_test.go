@@ -0,0 +1,98 @@
+package importer
+
+import (
+	"crypto/rand"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chirino/ssh"
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/chirino/svcteleporter/internal/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ed25519"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// connectIdleExporter connects an exporter that never sends a request to an ssh
+// server using the keepalives.  It returns the exporter's connection and the
+// number of keepalives it answered.  The server is closed with the exporter's
+// connection.
+func connectIdleExporter(t *testing.T, keepAlives *keepAlives) (*idleExporter, *int32) {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := gossh.NewSignerFromKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &ssh.Server{
+		HostSigners:          []ssh.Signer{signer},
+		ConnCallback:         keepAlives.watch,
+		ServerConfigCallback: keepAlives.serverConfig,
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, chans, reqs, err := gossh.NewClientConn(conn, "importer", &gossh.ClientConfig{HostKeyCallback: gossh.InsecureIgnoreHostKey()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for ch := range chans {
+			ch.Reject(gossh.Prohibited, "")
+		}
+	}()
+	answered := new(int32)
+	go func() {
+		for req := range reqs {
+			if req.Type == utils.KeepAliveRequestType {
+				atomic.AddInt32(answered, 1)
+			}
+			req.Reply(true, nil)
+		}
+	}()
+	return &idleExporter{Conn: c, server: server}, answered
+}
+
+type idleExporter struct {
+	gossh.Conn
+	server *ssh.Server
+}
+
+func (e *idleExporter) Close() error {
+	e.server.Close()
+	return e.Conn.Close()
+}
+
+func TestKeepAlivesStartOnConnect(t *testing.T) {
+	keepAlives := newKeepAlives(&cmd.KeepAliveSpec{Interval: cmd.Duration(10 * time.Millisecond)})
+	conn, answered := connectIdleExporter(t, keepAlives)
+
+	// The exporter never sends a request.
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, atomic.LoadInt32(answered) > 0, "the keepalives should start when the exporter connects")
+
+	keepAlives.Lock()
+	assert.Len(t, keepAlives.conns, 0, "the connection should not be tracked once its keepalives started")
+	keepAlives.Unlock()
+	conn.Close()
+}
+
+func TestKeepAlivesDisabled(t *testing.T) {
+	keepAlives := newKeepAlives(&cmd.KeepAliveSpec{Interval: cmd.Duration(10 * time.Millisecond), Disabled: true})
+	conn, answered := connectIdleExporter(t, keepAlives)
+	defer conn.Close()
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(answered))
+}
@@ -0,0 +1,139 @@
+package importer
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+)
+
+// destinationRule matches the host and port of a direct-tcpip destination.
+type destinationRule struct {
+	// host is an exact host name, a ".domain" suffix, or "*".  It's empty when
+	// the rule matches IPs.
+	host    string
+	network *net.IPNet
+	minPort uint32
+	maxPort uint32
+}
+
+// destinationPolicy is the list of rules that allow an exporter to reach a
+// cluster destination.  A destination that no rule matches is denied.
+type destinationPolicy []destinationRule
+
+// newDestinationPolicy builds the policy from the ReverseServices and the
+// DestinationPolicy of the importer config.
+func newDestinationPolicy(config *cmd.ImporterConfig) (destinationPolicy, error) {
+	policy := destinationPolicy{}
+	for _, target := range config.ReverseServices {
+		rule, err := parseDestinationRule(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid reverse service '%s': %v", target, err)
+		}
+		policy = append(policy, rule)
+	}
+	if config.DestinationPolicy != nil {
+		for _, pattern := range config.DestinationPolicy.Allow {
+			rule, err := parseDestinationRule(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("invalid destination policy pattern '%s': %v", pattern, err)
+			}
+			policy = append(policy, rule)
+		}
+	}
+	return policy, nil
+}
+
+func parseDestinationRule(pattern string) (rule destinationRule, err error) {
+	host, port, err := net.SplitHostPort(pattern)
+	if err != nil {
+		return rule, err
+	}
+
+	switch {
+	case port == "*":
+		rule.minPort, rule.maxPort = 0, 65535
+	case strings.Contains(port, "-"):
+		bounds := strings.SplitN(port, "-", 2)
+		if rule.minPort, err = parsePort(bounds[0]); err != nil {
+			return rule, err
+		}
+		if rule.maxPort, err = parsePort(bounds[1]); err != nil {
+			return rule, err
+		}
+		if rule.minPort > rule.maxPort {
+			return rule, fmt.Errorf("invalid port range: %s", port)
+		}
+	default:
+		if rule.minPort, err = parsePort(port); err != nil {
+			return rule, err
+		}
+		rule.maxPort = rule.minPort
+	}
+
+	switch {
+	case host == "":
+		return rule, fmt.Errorf("missing host")
+	case host == "*":
+		rule.host = host
+	case strings.Contains(host, "/"):
+		_, rule.network, err = net.ParseCIDR(host)
+		if err != nil {
+			return rule, err
+		}
+	case net.ParseIP(host) != nil:
+		ip := net.ParseIP(host)
+		bits := 8 * len(ip)
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 32
+		}
+		rule.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	case strings.HasPrefix(host, "*."):
+		rule.host = normalizeHost(host[1:])
+	default:
+		rule.host = normalizeHost(host)
+	}
+	return rule, nil
+}
+
+func parsePort(port string) (uint32, error) {
+	value, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port: %s", port)
+	}
+	return uint32(value), nil
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// allows reports if any rule of the policy matches the destination.
+func (p destinationPolicy) allows(host string, port uint32) bool {
+	ip := net.ParseIP(host)
+	name := normalizeHost(host)
+	for _, rule := range p {
+		if port < rule.minPort || port > rule.maxPort {
+			continue
+		}
+		switch {
+		case rule.host == "*":
+			return true
+		case rule.network != nil:
+			if ip != nil && rule.network.Contains(ip) {
+				return true
+			}
+		case ip != nil:
+			// IP destinations are only matched by IP and CIDR rules.
+		case strings.HasPrefix(rule.host, "."):
+			if strings.HasSuffix(name, rule.host) {
+				return true
+			}
+		case name == rule.host:
+			return true
+		}
+	}
+	return false
+}
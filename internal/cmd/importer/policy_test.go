@@ -0,0 +1,51 @@
+package importer
+
+import (
+	"testing"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDestinationPolicy(t *testing.T) {
+	policy, err := newDestinationPolicy(&cmd.ImporterConfig{
+		ReverseServices: []string{"postgres:5432"},
+		DestinationPolicy: &cmd.DestinationPolicy{
+			Allow: []string{
+				"*.apps.svc.cluster.local:8000-8099",
+				"10.1.0.0/16:*",
+				"[fd00::1]:443",
+				"Redis.:6379",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.True(t, policy.allows("postgres", 5432))
+	assert.False(t, policy.allows("postgres", 5433))
+	assert.False(t, policy.allows("postgres.evil.com", 5432))
+
+	assert.True(t, policy.allows("web.apps.svc.cluster.local", 8080))
+	assert.False(t, policy.allows("web.apps.svc.cluster.local", 8100))
+	assert.False(t, policy.allows("apps.svc.cluster.local", 8080))
+
+	assert.True(t, policy.allows("10.1.2.3", 22))
+	assert.False(t, policy.allows("10.2.2.3", 22))
+	assert.True(t, policy.allows("fd00::1", 443))
+	assert.True(t, policy.allows("redis", 6379))
+
+	// default deny
+	assert.False(t, policy.allows("kubernetes.default.svc", 443))
+	assert.False(t, policy.allows("172.30.0.1", 443))
+}
+
+func TestInvalidDestinationPolicy(t *testing.T) {
+	for _, pattern := range []string{"postgres", "postgres:abc", "postgres:99999", "postgres:90-80", "10.0.0.0/33:80", ":80"} {
+		_, err := newDestinationPolicy(&cmd.ImporterConfig{
+			DestinationPolicy: &cmd.DestinationPolicy{Allow: []string{pattern}},
+		})
+		assert.Error(t, err, pattern)
+	}
+}
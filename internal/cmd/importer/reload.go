@@ -0,0 +1,50 @@
+package importer
+
+import (
+	"context"
+	"log"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+)
+
+// watchConfigFile calls onChange with the new config whenever the contents of the
+// config file, or of the certificate files it references, change.
+func watchConfigFile(ctx context.Context, file string, onChange func(*cmd.ImporterConfig)) {
+	config, _ := LoadConfigFile(file)
+	files := func() []string {
+		files := []string{file}
+		if config != nil {
+			files = append(files, config.TLSFiles()...)
+		}
+		return files
+	}
+	cmd.WatchFiles(ctx, files, func() {
+		changed, err := LoadConfigFile(file)
+		if err != nil {
+			log.Println("importer:ignoring invalid config change:", err)
+			return
+		}
+		config = changed
+		log.Println("importer:config or certificate files changed:", file)
+		onChange(config)
+	})
+}
+
+// accessRules decide what the exporters are allowed to do.  They are replaced as a
+// whole when the config is reloaded.
+type accessRules struct {
+	policy         destinationPolicy
+	authorizations authorizations
+}
+
+func newAccessRules(config *cmd.ImporterConfig) (*accessRules, error) {
+	policy, err := newDestinationPolicy(config)
+	if err != nil {
+		return nil, err
+	}
+	authorizations, err := newAuthorizations(config)
+	if err != nil {
+		return nil, err
+	}
+	return &accessRules{policy: policy, authorizations: authorizations}, nil
+}
@@ -0,0 +1,104 @@
+package importer
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+)
+
+// revocations rejects the exporter certificates that are listed in the CRL or in
+// the RevokedSerials of the config.
+type revocations struct {
+	serials map[string]bool
+	// crlSerials holds the serials revoked by the CRL keyed by the raw subject of
+	// the CA that signed it, since serials are only unique per issuer.
+	crlSerials map[string]map[string]bool
+}
+
+func newRevocations(config *cmd.ImporterConfig) (*revocations, error) {
+	r := &revocations{
+		serials:    map[string]bool{},
+		crlSerials: map[string]map[string]bool{},
+	}
+	for _, serial := range config.RevokedSerials {
+		value, err := cmd.ParseSerialNumber(serial)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RevokedSerials: %v", err)
+		}
+		r.serials[value.String()] = true
+	}
+	if config.CRL == "" {
+		return r, nil
+	}
+
+	crl, err := x509.ParseCRL([]byte(config.CRL))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CRL: %v", err)
+	}
+	var issuer *x509.Certificate
+	for _, certs := range config.CAs {
+		for _, ca := range parseCerts(certs) {
+			if ca.CheckCRLSignature(crl) == nil {
+				issuer = ca
+				break
+			}
+		}
+	}
+	if issuer == nil {
+		return nil, fmt.Errorf("invalid CRL: it was not signed by any of the CAs")
+	}
+	if crl.HasExpired(time.Now()) {
+		log.Println("importer:warning: the CRL is past its next update time, it still gets enforced")
+	}
+	serials := map[string]bool{}
+	for _, revoked := range crl.TBSCertList.RevokedCertificates {
+		serials[revoked.SerialNumber.String()] = true
+	}
+	r.crlSerials[string(issuer.RawSubject)] = serials
+	return r, nil
+}
+
+// revoked reports if the certificate has been revoked.
+func (r *revocations) revoked(cert *x509.Certificate) bool {
+	serial := cert.SerialNumber.String()
+	if r.serials[serial] {
+		return true
+	}
+	return r.crlSerials[string(cert.RawIssuer)][serial]
+}
+
+// verifyPeerCertificate is a tls.Config VerifyPeerCertificate hook that fails the
+// handshake of exporters whose certificate, or one of its issuers, was revoked.
+func (r *revocations) verifyPeerCertificate(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if r.revoked(cert) {
+				return fmt.Errorf("certificate %s with serial %s has been revoked", certIdentity(cert), cmd.SerialNumber(cert))
+			}
+		}
+	}
+	return nil
+}
+
+// parseCerts parses the PEM encoded certificates in data.
+func parseCerts(data string) []*x509.Certificate {
+	certs := []*x509.Certificate{}
+	rest := []byte(data)
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			return certs
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			certs = append(certs, cert)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/chirino/svcteleporter/internal/pkg/pki"
+	"github.com/stretchr/testify/assert"
+)
+
+func issueTestCert(t *testing.T, ca *pki.CA, identity string) (*x509.Certificate, string, string) {
+	certPEM, keyPEM, err := ca.Issue(pki.KeyTypeECDSAP256, 0, time.Hour, identity, x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode([]byte(certPEM))
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, certPEM, keyPEM
+}
+
+func createTestCRL(t *testing.T, ca *pki.CA, revoked ...*x509.Certificate) string {
+	entries := []pkix.RevokedCertificate{}
+	for _, cert := range revoked {
+		entries = append(entries, pkix.RevokedCertificate{SerialNumber: cert.SerialNumber, RevocationTime: time.Now()})
+	}
+	der, err := ca.Cert.CreateCRL(rand.Reader, ca.Key, entries, time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := bytes.NewBuffer(nil)
+	pem.Encode(out, &pem.Block{Type: "X509 CRL", Bytes: der})
+	return out.String()
+}
+
+func TestRevocations(t *testing.T) {
+	ca, err := pki.NewCA(pki.KeyTypeECDSAP256, 0, time.Hour, "test-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	siteA, _, _ := issueTestCert(t, ca, "site-a")
+	siteB, _, _ := issueTestCert(t, ca, "site-b")
+	siteC, _, _ := issueTestCert(t, ca, "site-c")
+	verify := func(r *revocations, cert *x509.Certificate) error {
+		return r.verifyPeerCertificate(nil, [][]*x509.Certificate{{cert, ca.Cert}})
+	}
+
+	r, err := newRevocations(&cmd.ImporterConfig{CAs: []string{ca.CertPEM}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, verify(r, siteA))
+
+	r, err = newRevocations(&cmd.ImporterConfig{
+		CAs:            []string{ca.CertPEM},
+		RevokedSerials: []string{cmd.SerialNumber(siteA)},
+		CRL:            createTestCRL(t, ca, siteB),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.EqualError(t, verify(r, siteA), "certificate site-a with serial "+cmd.SerialNumber(siteA)+" has been revoked")
+	assert.Error(t, verify(r, siteB))
+	assert.NoError(t, verify(r, siteC))
+
+	otherCA, err := pki.NewCA(pki.KeyTypeECDSAP256, 0, time.Hour, "other-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = newRevocations(&cmd.ImporterConfig{CAs: []string{ca.CertPEM}, CRL: createTestCRL(t, otherCA, siteB)})
+	assert.EqualError(t, err, "invalid CRL: it was not signed by any of the CAs")
+	_, err = newRevocations(&cmd.ImporterConfig{RevokedSerials: []string{"xyz"}})
+	assert.Error(t, err)
+}
+
+func TestReloadClosesRevokedSessions(t *testing.T) {
+	ca, err := pki.NewCA(pki.KeyTypeECDSAP256, 0, time.Hour, "test-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	importerCert, certPEM, keyPEM := issueTestCert(t, ca, "importer")
+	siteA, _, _ := issueTestCert(t, ca, "site-a")
+	config := &cmd.ImporterConfig{Cert: certPEM, Key: keyPEM, CAs: []string{ca.CertPEM}}
+	importer, err := NewFromConfig(context.Background(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessions := map[*x509.Certificate]net.Conn{}
+	for _, cert := range []*x509.Certificate{importerCert, siteA} {
+		local, remote := net.Pipe()
+		defer local.Close()
+		conn := &identifiedConn{Conn: local, remoteAddr: &peerAddr{Addr: local.RemoteAddr(), Cert: cert}}
+		importer.sessions.Store(conn, true)
+		sessions[cert] = remote
+	}
+
+	config.RevokedSerials = []string{cmd.SerialNumber(siteA)}
+	if err := importer.ReloadTLS(config); err != nil {
+		t.Fatal(err)
+	}
+	closed := func(conn net.Conn) bool {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		_, err := conn.Read(make([]byte, 1))
+		ne, ok := err.(net.Error)
+		return !(ok && ne.Timeout())
+	}
+	assert.True(t, closed(sessions[siteA]), "the revoked session should be closed")
+	assert.False(t, closed(sessions[importerCert]), "other sessions should be kept")
+}
@@ -1,158 +1,357 @@
 package importer
 
 //
-// Copied from https://github.com/gliderlabs/ssh/blob/master/tcpip.go and modified a bit.
+// Based on https://github.com/gliderlabs/ssh/blob/master/tcpip.go but modified to
+// forward services by name.
 //
 
 import (
+	"context"
+	"fmt"
 	"github.com/chirino/ssh"
 	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/chirino/svcteleporter/internal/pkg/metrics"
+	"github.com/chirino/svcteleporter/internal/pkg/protocol"
+	"github.com/chirino/svcteleporter/internal/pkg/utils"
 	gossh "golang.org/x/crypto/ssh"
 	"io"
 	"log"
 	"net"
+	"os"
 	"strconv"
 	"sync"
 )
 
-type remoteForwardRequest struct {
-	BindAddr string
-	BindPort uint32
-}
-
-type remoteForwardSuccess struct {
-	BindPort uint32
-}
-
-type remoteForwardCancelRequest struct {
-	BindAddr string
-	BindPort uint32
-}
-
-type remoteForwardChannelData struct {
-	DestAddr   string
-	DestPort   uint32
-	OriginAddr string
-	OriginPort uint32
+type serviceForward struct {
+	listener io.Closer
+	conn     *gossh.ServerConn
+	ctx      ssh.Context
+	// network, address and udp describe what the listener was opened for so that
+	// a reload can tell if it has to be opened again.
+	network string
+	address string
+	udp     bool
 }
 
 // ForwardedTCPHandler can be enabled by creating a ForwardedTCPHandler and
 // adding the HandleSSHRequest callback to the server's RequestHandlers under
-// tcpip-forward and cancel-tcpip-forward.
+// the protocol.ServiceForwardRequest and protocol.CancelServiceForwardRequest
+// request types.
 type ForwardedTCPHandler struct {
-	forwards map[string]net.Listener
+	forwards map[string]*serviceForward
 	sync.Mutex
 	config *cmd.ImporterConfig
+	// context is canceled when the importer shuts down, no new forwards are
+	// accepted after that.
+	context context.Context
+	// streams counts the connections being relayed to the exporters.
+	streams utils.Streams
+}
+
+// lookupService finds the configured service with the given name.
+func (h *ForwardedTCPHandler) lookupService(name string) (int, *cmd.ProxySpec) {
+	for i := range h.config.Services {
+		if h.config.Services[i].KubeService == name {
+			return i, &h.config.Services[i]
+		}
+	}
+	return -1, nil
 }
 
 func (h *ForwardedTCPHandler) HandleSSHRequest(ctx ssh.Context, srv *ssh.Server, req *gossh.Request) (bool, []byte) {
 	h.Lock()
 	if h.forwards == nil {
-		h.forwards = make(map[string]net.Listener)
+		h.forwards = make(map[string]*serviceForward)
 	}
 	h.Unlock()
 	conn := ctx.Value(ssh.ContextKeyConn).(*gossh.ServerConn)
-	switch req.Type {
-	case "tcpip-forward":
-		var reqPayload remoteForwardRequest
-		if err := gossh.Unmarshal(req.Payload, &reqPayload); err != nil {
-			// TODO: log parse failure
-			return false, []byte{}
-		}
-		addr := net.JoinHostPort(reqPayload.BindAddr, strconv.Itoa(int(reqPayload.BindPort)))
 
-		ln, err := net.Listen("tcp", addr)
-		if err != nil {
-			// TODO: log listen failure
-			return false, []byte{}
+	var reqPayload protocol.ServiceForward
+	if err := gossh.Unmarshal(req.Payload, &reqPayload); err != nil {
+		log.Println("importer:invalid", req.Type, "request:", err)
+		return false, []byte(fmt.Sprintf("invalid request: %v", err))
+	}
+	name := reqPayload.Service
+
+	switch req.Type {
+	case protocol.ServiceForwardRequest:
+		if h.shuttingDown() {
+			log.Println("importer:rejected forward of service", name, "while shutting down")
+			return false, []byte("the importer is shutting down")
 		}
-		log.Println("importer:listening on ", addr)
-		_, destPortStr, _ := net.SplitHostPort(ln.Addr().String())
-		destPort, _ := strconv.Atoi(destPortStr)
 		h.Lock()
-		h.forwards[addr] = ln
+		_, service := h.lookupService(name)
 		h.Unlock()
-		go func() {
-			<-ctx.Done()
-			h.Lock()
-			ln, ok := h.forwards[addr]
+		if service == nil {
+			log.Println("importer:rejected forward of unknown service:", name)
+			return false, []byte(fmt.Sprintf("unknown service: %s", name))
+		}
+		if srv.ReversePortForwardingCallback == nil || !srv.ReversePortForwardingCallback(ctx, name, service.KubePort) {
+			log.Println("importer:rejected forward of service", name, "from exporter", peerIdentity(ctx))
+			return false, []byte(fmt.Sprintf("forwarding service %s is not permitted", name))
+		}
+
+		h.Lock()
+		if _, held := h.forwards[name]; held {
 			h.Unlock()
-			if ok {
-				ln.Close()
-			}
-		}()
-		go func() {
-			for {
-				localConn, err := ln.Accept()
-				if err != nil {
-					log.Println("importer:accept error", err)
-					break
-				}
-				log.Println("importer:connected exporter on: ", addr)
-				originAddr, orignPortStr, _ := net.SplitHostPort(localConn.RemoteAddr().String())
-				originPort, _ := strconv.Atoi(orignPortStr)
-				payload := gossh.Marshal(&remoteForwardChannelData{
-					DestAddr:   reqPayload.BindAddr,
-					DestPort:   uint32(destPort),
-					OriginAddr: originAddr,
-					OriginPort: uint32(originPort),
-				})
-				go func() {
-					sshConn, reqs, err := conn.OpenChannel("forwarded-tcpip", payload)
-					if err != nil {
-						// TODO: log failure to open channel
-						log.Println("importer:tunnel dial error:", err)
-						localConn.Close()
-						return
-					}
-
-					log.Println("importer:tunnel to exporter:tunnel connected")
-					go gossh.DiscardRequests(reqs)
-					go func() {
-						defer sshConn.Close()
-						defer localConn.Close()
-						_, err := io.Copy(sshConn, localConn)
-						if err != nil {
-							log.Println("importer:tunnel -> exporter:tunnel closed. error: ", err)
-						} else {
-							log.Println("importer:tunnel -> exporter:tunnel closed.")
-						}
-
-					}()
-					go func() {
-						defer sshConn.Close()
-						defer localConn.Close()
-						_, err := io.Copy(localConn, sshConn)
-						if err != nil {
-							log.Println("importer:tunnel <- exporter:tunnel closed. error: ", err)
-						} else {
-							log.Println("importer:tunnel <- exporter:tunnel closed.")
-						}
-					}()
-				}()
-			}
-			h.Lock()
-			delete(h.forwards, addr)
+			log.Println("importer:rejected forward of service already held by another exporter:", name, "from exporter", peerIdentity(ctx))
+			return false, []byte(fmt.Sprintf("service %s is already exported by another exporter", name))
+		}
+		if err := h.listen(ctx, name, conn); err != nil {
 			h.Unlock()
-		}()
-		return true, gossh.Marshal(&remoteForwardSuccess{uint32(destPort)})
-
-	case "cancel-tcpip-forward":
-		var reqPayload remoteForwardCancelRequest
-		if err := gossh.Unmarshal(req.Payload, &reqPayload); err != nil {
-			// TODO: log parse failure
-			return false, []byte{}
+			log.Println("importer:listen error for service", name, ":", err)
+			return false, []byte(fmt.Sprintf("could not listen for service %s: %v", name, err))
 		}
-		addr := net.JoinHostPort(reqPayload.BindAddr, strconv.Itoa(int(reqPayload.BindPort)))
+		h.Unlock()
+		return true, nil
+
+	case protocol.CancelServiceForwardRequest:
 		h.Lock()
-		ln, ok := h.forwards[addr]
+		forward, ok := h.forwards[name]
 		h.Unlock()
-		if ok {
-			log.Println("importer:disconnected exporter on: ", addr)
-			ln.Close()
+		if ok && forward.conn == conn {
+			log.Println("importer:disconnected exporter for service:", name)
+			forward.listener.Close()
 		}
 		return true, nil
 	default:
 		return false, nil
 	}
 }
+
+// listen opens the listener of the service for the exporter connection.  It's
+// called with the lock held.
+func (h *ForwardedTCPHandler) listen(ctx ssh.Context, name string, conn *gossh.ServerConn) error {
+	i, service := h.lookupService(name)
+	if service == nil {
+		return fmt.Errorf("unknown service: %s", name)
+	}
+	network, addr := h.serviceListenAddress(i)
+	udp := service.IsUDP()
+	var ln io.Closer
+	var err error
+	if udp {
+		ln, err = net.ListenPacket(network, addr)
+	} else {
+		ln, err = listenStream(network, addr)
+	}
+	if err != nil {
+		return err
+	}
+	forward := &serviceForward{listener: ln, conn: conn, ctx: ctx, network: network, address: addr, udp: udp}
+	h.forwards[name] = forward
+
+	log.Println("importer:listening for service", name, "on", addr)
+	udpIdleTimeout := h.config.UDPIdleTimeout.OrDefault(cmd.DefaultUDPIdleTimeout)
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	go func() {
+		if udp {
+			serveDatagrams(ln.(net.PacketConn), conn, name, udpIdleTimeout, &h.streams)
+		} else {
+			serveStreams(ln.(net.Listener), conn, name, &h.streams)
+		}
+		h.Lock()
+		if h.forwards[name] == forward {
+			delete(h.forwards, name)
+		}
+		h.Unlock()
+	}()
+	return nil
+}
+
+// Reload switches to the Services of the config.  The listeners of the services
+// that were removed, or that their exporter is no longer authorized to publish,
+// are closed.  The ones of the services whose listen address or protocol changed
+// are opened again.  The connections that were already accepted, and the
+// listeners of the unchanged services, are not affected.  Services without a
+// ListenPort keep the port they are bound to, even if their position in the
+// Services changed.
+func (h *ForwardedTCPHandler) Reload(config *cmd.ImporterConfig, authorizations authorizations) {
+	h.Lock()
+	defer h.Unlock()
+	h.config = config
+	moved := map[string]*serviceForward{}
+	for name, forward := range h.forwards {
+		i, service := h.lookupService(name)
+		if service == nil {
+			log.Println("importer:service removed, closing its listener:", name)
+			forward.listener.Close()
+			delete(h.forwards, name)
+			continue
+		}
+		if !authorizations.allows(peerCert(forward.ctx), name) {
+			log.Println("importer:exporter", peerIdentity(forward.ctx), "is no longer authorized to publish service, closing its listener:", name)
+			forward.listener.Close()
+			delete(h.forwards, name)
+			continue
+		}
+		network, addr := h.serviceListenAddress(i)
+		if network == forward.network && addr == forward.address && service.IsUDP() == forward.udp {
+			continue
+		}
+		log.Println("importer:service", name, "changed, moving its listener from", forward.address, "to", addr)
+		forward.listener.Close()
+		delete(h.forwards, name)
+		moved[name] = forward
+	}
+	// The moved listeners are opened once all the old ones are closed so that a
+	// service can take over an address that another one moved away from.
+	for name, forward := range moved {
+		if err := h.listen(forward.ctx, name, forward.conn); err != nil {
+			log.Println("importer:listen error for service", name, ":", err)
+			forwardClosed(forward.conn, name)
+		}
+	}
+}
+
+// serviceListenAddress is the ServiceListenAddress of the service at index i of
+// the Services.  A service without a ListenPort stays on the port it's bound to,
+// so that adding or removing other services does not move it.  It's called with
+// the lock held.
+func (h *ForwardedTCPHandler) serviceListenAddress(i int) (network string, address string) {
+	network, address = h.config.ServiceListenAddress(i)
+	service := h.config.Services[i]
+	forward, ok := h.forwards[service.KubeService]
+	if !ok || service.ListenPort != 0 || network != forward.network {
+		return network, address
+	}
+	host, _, _ := net.SplitHostPort(address)
+	boundHost, boundPort, _ := net.SplitHostPort(forward.address)
+	if host != boundHost {
+		return network, address
+	}
+	return network, net.JoinHostPort(host, boundPort)
+}
+
+// forwardClosed tells the exporter that the importer stopped accepting connections
+// for the service.
+func forwardClosed(conn gossh.Conn, name string) {
+	go func() {
+		_, _, err := conn.SendRequest(protocol.ServiceForwardClosedRequest, false, gossh.Marshal(&protocol.ServiceForward{Service: name}))
+		if err != nil {
+			log.Println("importer:could not tell the exporter that the forward of service", name, "was closed:", err)
+		}
+	}()
+}
+
+func (h *ForwardedTCPHandler) shuttingDown() bool {
+	if h.context == nil {
+		return false
+	}
+	select {
+	case <-h.context.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// ready reports if an exporter holds the service.
+func (h *ForwardedTCPHandler) ready(name string) error {
+	h.Lock()
+	defer h.Unlock()
+	if _, service := h.lookupService(name); service == nil {
+		return fmt.Errorf("unknown service: %s", name)
+	}
+	if _, held := h.forwards[name]; !held {
+		return fmt.Errorf("no exporter holds service: %s", name)
+	}
+	return nil
+}
+
+// readyAny reports if an exporter holds any of the services.
+func (h *ForwardedTCPHandler) readyAny() error {
+	h.Lock()
+	defer h.Unlock()
+	if len(h.forwards) == 0 {
+		return fmt.Errorf("no exporter holds any service")
+	}
+	return nil
+}
+
+// Shutdown closes the listeners of all the services so that no new connections
+// are accepted.  The connections that were already accepted are not affected.
+func (h *ForwardedTCPHandler) Shutdown() {
+	h.Lock()
+	defer h.Unlock()
+	for name, forward := range h.forwards {
+		log.Println("importer:shutting down, closing the listener of service:", name)
+		forward.listener.Close()
+		delete(h.forwards, name)
+	}
+}
+
+// listenStream listens for stream connections.  Stale unix sockets left behind by
+// a previous importer process are removed first.
+func listenStream(network string, addr string) (net.Listener, error) {
+	if network == "unix" {
+		if info, err := os.Lstat(addr); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+	}
+	return net.Listen(network, addr)
+}
+
+// serveStreams forwards every connection accepted for the service to the exporter
+// over a new ssh channel.  The connections are counted in streams until they
+// close.
+func serveStreams(ln net.Listener, conn gossh.Conn, name string, streams *utils.Streams) {
+	for {
+		localConn, err := ln.Accept()
+		if err != nil {
+			log.Println("importer:accept error", err)
+			return
+		}
+		log.Println("importer:connected exporter for service:", name)
+		originAddr, orignPortStr, _ := net.SplitHostPort(localConn.RemoteAddr().String())
+		originPort, _ := strconv.Atoi(orignPortStr)
+		payload := gossh.Marshal(&protocol.ForwardedService{
+			Service:    name,
+			OriginAddr: originAddr,
+			OriginPort: uint32(originPort),
+		})
+		done := streams.Add()
+		connDone := metrics.Connection(name)
+		go func() {
+			sshConn, reqs, err := conn.OpenChannel(protocol.ForwardedServiceChannel, payload)
+			if err != nil {
+				log.Println("importer:tunnel dial error:", err)
+				localConn.Close()
+				connDone()
+				done()
+				return
+			}
+
+			log.Println("importer:tunnel to exporter:tunnel connected")
+			go gossh.DiscardRequests(reqs)
+			go func() {
+				defer done()
+				defer connDone()
+				defer sshConn.Close()
+				defer localConn.Close()
+				_, err := metrics.Copy(name, metrics.In, sshConn, localConn)
+				if err != nil {
+					log.Println("importer:tunnel -> exporter:tunnel closed. error: ", err)
+				} else {
+					log.Println("importer:tunnel -> exporter:tunnel closed.")
+				}
+
+			}()
+			go func() {
+				defer done()
+				defer connDone()
+				defer sshConn.Close()
+				defer localConn.Close()
+				_, err := metrics.Copy(name, metrics.Out, localConn, sshConn)
+				if err != nil {
+					log.Println("importer:tunnel <- exporter:tunnel closed. error: ", err)
+				} else {
+					log.Println("importer:tunnel <- exporter:tunnel closed.")
+				}
+			}()
+		}()
+	}
+}
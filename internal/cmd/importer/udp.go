@@ -0,0 +1,152 @@
+package importer
+
+import (
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/chirino/svcteleporter/internal/pkg/metrics"
+	"github.com/chirino/svcteleporter/internal/pkg/protocol"
+	"github.com/chirino/svcteleporter/internal/pkg/utils"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// serveDatagrams relays the datagrams received for a udp service to the exporter.
+// Every client address gets its own ssh channel which is closed once no datagrams
+// flow through it for the idle timeout.  The sessions are counted in streams until
+// they close.  Since the replies are sent from the listener, they all close with
+// it.
+func serveDatagrams(pc net.PacketConn, conn gossh.Conn, name string, idleTimeout time.Duration, streams *utils.Streams) {
+	mu := sync.Mutex{}
+	sessions := map[string]*datagramSession{}
+	defer func() {
+		mu.Lock()
+		for _, session := range sessions {
+			session.close()
+		}
+		mu.Unlock()
+	}()
+
+	buf := make([]byte, protocol.MaxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			log.Println("importer:udp read error", err)
+			return
+		}
+
+		key := addr.String()
+		mu.Lock()
+		session := sessions[key]
+		if session == nil {
+			session = newDatagramSession(idleTimeout)
+			sessions[key] = session
+			done := streams.Add()
+			go func() {
+				defer done()
+				session.run(pc, conn, name, addr)
+				mu.Lock()
+				if sessions[key] == session {
+					delete(sessions, key)
+				}
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+
+		datagram := make([]byte, n)
+		copy(datagram, buf[:n])
+		session.offer(datagram)
+	}
+}
+
+// datagramSession relays the datagrams of one client address over an ssh channel.
+type datagramSession struct {
+	outbound    chan []byte
+	done        chan struct{}
+	closeOnce   sync.Once
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+}
+
+func newDatagramSession(idleTimeout time.Duration) *datagramSession {
+	session := &datagramSession{
+		outbound:    make(chan []byte, 64),
+		done:        make(chan struct{}),
+		idleTimeout: idleTimeout,
+	}
+	session.idleTimer = time.AfterFunc(idleTimeout, session.close)
+	return session
+}
+
+func (s *datagramSession) close() {
+	s.closeOnce.Do(func() {
+		s.idleTimer.Stop()
+		close(s.done)
+	})
+}
+
+func (s *datagramSession) touch() {
+	s.idleTimer.Reset(s.idleTimeout)
+}
+
+// offer queues a datagram for the exporter.  Like udp, datagrams get dropped
+// if the tunnel can't keep up.
+func (s *datagramSession) offer(datagram []byte) {
+	select {
+	case s.outbound <- datagram:
+	case <-s.done:
+	default:
+	}
+}
+
+func (s *datagramSession) run(pc net.PacketConn, conn gossh.Conn, name string, addr net.Addr) {
+	defer s.close()
+	originAddr, orignPortStr, _ := net.SplitHostPort(addr.String())
+	originPort, _ := strconv.Atoi(orignPortStr)
+	payload := gossh.Marshal(&protocol.ForwardedService{
+		Service:    name,
+		OriginAddr: originAddr,
+		OriginPort: uint32(originPort),
+	})
+	channel, reqs, err := conn.OpenChannel(protocol.ForwardedDatagramChannel, payload)
+	if err != nil {
+		log.Println("importer:udp tunnel dial error:", err)
+		return
+	}
+	defer channel.Close()
+	defer metrics.Connection(name)()
+	go gossh.DiscardRequests(reqs)
+	log.Println("importer:udp tunnel to exporter connected for:", addr)
+
+	go func() {
+		defer s.close()
+		buf := make([]byte, protocol.MaxDatagramSize)
+		for {
+			n, err := protocol.ReadDatagram(channel, buf)
+			if err != nil {
+				return
+			}
+			s.touch()
+			if n, err := pc.WriteTo(buf[:n], addr); err == nil {
+				metrics.Relayed(name, metrics.Out, n)
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-s.done:
+			log.Println("importer:udp tunnel to exporter closed for:", addr)
+			return
+		case datagram := <-s.outbound:
+			s.touch()
+			if err := protocol.WriteDatagram(channel, datagram); err != nil {
+				return
+			}
+			metrics.Relayed(name, metrics.In, len(datagram))
+		}
+	}
+}
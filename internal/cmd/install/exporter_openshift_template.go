@@ -35,8 +35,17 @@ items:
           - name: svcteleporter-import
             image: quay.io/hchirino/svcteleporter:latest
             imagePullPolicy: Always
-            command: [ "/usr/local/bin/svcteleporter", "exporter", "/config/config.yaml" ]
+            command: [ "/usr/local/bin/svcteleporter", "exporter", "/config/config.yaml", "--health-listen", ":8080" ]
             volumeMounts:
               - name: config-volume
                 mountPath: /config
+            livenessProbe:
+              httpGet:
+                path: /healthz
+                port: 8080
+            readinessProbe:
+              httpGet:
+                path: /readyz
+                port: 8080
+              periodSeconds: 5
 `
@@ -28,7 +28,7 @@ items:
       - port: 1443
         protocol: TCP
         targetPort: 1443
-{{range $i,$val := .ImporterConfig.Services}}
+{{range $i,$val := .ImporterConfig.Services}}{{if not $val.ListenPath}}
 - apiVersion: v1
   kind: Service
   metadata:
@@ -37,10 +37,10 @@ items:
     selector:
       app: svcteleporter-importer
     ports:
-      - protocol: TCP
+      - protocol: {{$val.KubeProtocol}}
         port: {{$val.KubePort}}
-        targetPort: {{add 2000 $i}}
-{{end}}
+        targetPort: {{$val.ListenPort}}
+{{end}}{{end}}
 
 - apiVersion: v1
   kind: Secret
@@ -73,13 +73,23 @@ items:
           - name: svcteleporter-import
             image: quay.io/hchirino/svcteleporter:latest
             imagePullPolicy: Always
-            command: [ "/usr/local/bin/svcteleporter", "importer", "/config/config.yaml" ]
+            command: [ "/usr/local/bin/svcteleporter", "importer", "/config/config.yaml", "--health-listen", ":8080" ]
             volumeMounts:
               - name: config-volume
                 mountPath: /config
+            livenessProbe:
+              httpGet:
+                path: /healthz
+                port: 8080
+            readinessProbe:
+              httpGet:
+                path: /readyz
+                port: 8080
+              periodSeconds: 5
             ports:
               - containerPort: 1443
-{{range $i, $val := .ImporterConfig.Services}}
-              - containerPort: {{add 2000 $i}}
-{{end}}
+{{range $i, $val := .ImporterConfig.Services}}{{if not $val.ListenPath}}
+              - containerPort: {{$val.ListenPort}}
+                protocol: {{$val.KubeProtocol}}
+{{end}}{{end}}
 `
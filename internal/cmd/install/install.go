@@ -2,20 +2,17 @@ package install
 
 import (
     "bytes"
-    "crypto/rand"
-    "crypto/rsa"
     "crypto/x509"
-    "crypto/x509/pkix"
     "encoding/base64"
-    "encoding/pem"
     "flag"
     "fmt"
     "github.com/chirino/svcteleporter/internal/cmd"
+    "github.com/chirino/svcteleporter/internal/pkg/pki"
     "github.com/chirino/svcteleporter/internal/pkg/utils"
     "github.com/spf13/cobra"
+    "golang.org/x/crypto/ssh"
     "io/ioutil"
-    "log"
-    "math/big"
+    "os"
     "sigs.k8s.io/yaml"
     "strings"
     "text/template"
@@ -33,30 +30,35 @@ func New() *cobra.Command {
         Proxies: []cmd.ProxySpec{},
     }
     command := &cobra.Command{Use: `install [[kube-service[:port],]target-host:target:port]+`}
+    reverseProxies := []string{}
 
-    // Lets rexport the flags installed by the controller runtime, and make them a little less kube specific
-    f := *flag.CommandLine.Lookup("kubeconfig")
-    f.Name = "config"
-    f.Usage = "path to the config file to connect to the cluster"
-    command.PersistentFlags().AddGoFlag(&f)
-
-    f = *flag.CommandLine.Lookup("master")
-    f.Usage = "the address of the cluster API server."
-    command.PersistentFlags().AddGoFlag(&f)
-
-    // cmd.PersistentFlags().StringVar(&options.KubeConfig, "config", , "path to the config file to connect to the cluster")
-    namespace, _ := GetClientNamespace(o.KubeConfig)
-    command.PersistentFlags().StringVarP(&o.Namespace, "namespace", "n", namespace, "namespace to run against")
+    AddClusterFlags(command, &o)
 
     command.Flags().StringVar(&o.ImporterHostPort, "importer-host-port", "", "The public hostname:port the importer will run at")
     command.Flags().StringVar(&o.Prefix, "config-prefix", "", "config file prefix")
+    command.Flags().StringVar(&o.CAFile, "ca", "", "the file holding the CA that issues the certificates. it's created if it does not exist. defaults to <config-prefix>ca.yaml")
+    command.Flags().StringVar(&o.CACertFile, "ca-cert", "", "PEM file with the CA certificates that issued the --importer-cert and --exporter-cert, or with the CA certificate to sign from when used with --ca-key")
+    command.Flags().StringVar(&o.CAKeyFile, "ca-key", "", "PEM file with the private key of the --ca-cert CA. the certificates are signed by it instead of the CA in the --ca file")
+    command.Flags().StringVar(&o.ImporterCertFile, "importer-cert", "", "PEM file with an existing importer certificate, followed by its intermediates. requires --importer-key, --exporter-cert, --exporter-key and --ca-cert")
+    command.Flags().StringVar(&o.ImporterKeyFile, "importer-key", "", "PEM file with the private key of the --importer-cert")
+    command.Flags().StringVar(&o.ExporterCertFile, "exporter-cert", "", "PEM file with an existing exporter certificate, followed by its intermediates")
+    command.Flags().StringVar(&o.ExporterKeyFile, "exporter-key", "", "PEM file with the private key of the --exporter-cert")
+    command.Flags().StringVar(&o.ExporterProxy, "exporter-proxy", "", "the http://[user:password@]host:port or socks5://[user:password@]host:port proxy the exporter uses to reach the importer")
+    command.Flags().StringVar(&o.UpstreamProxy, "upstream-proxy", "", "the socks5://[user:password@]host:port proxy the exporter uses to reach the upstream services")
+    command.Flags().StringArrayVar(&reverseProxies, "reverse", nil, "a kube-service:port[,listen-host:listen-port|unix:/listen/path] cluster service the exporter should expose locally. can be repeated.")
+    command.Flags().StringVar(&o.Transport, "transport", cmd.TransportTLS, "the transport the exporter uses to connect to the importer. one of: tls or wss. both need the importer to terminate TLS, so it can not run behind an edge terminating Ingress or Route.")
     command.Flags().DurationVar(&o.Duration, "duration", 10*365*24*time.Hour, "duration that mutual TLS certificates will be valid for")
+    command.Flags().StringVar(&o.KeyType, "key-type", pki.KeyTypeECDSAP256, "the type of key to generate for the CA and certificates. one of: "+strings.Join(pki.KeyTypes, ", ")+".")
     command.Flags().IntVar(&o.KeySize, "key-size", 4096, "size of RSA key to generate.")
+    command.Flags().StringVar(&o.HostKeyType, "host-key-type", "ed25519", "the type of ssh host key to generate for the importer. one of: ed25519, ecdsa or rsa.")
     command.Flags().StringArrayVar(&o.Kinds, "output", []string{"openshift", "standalone"}, "the types of configuration outputs to generate. on of: openshif or standalone.")
     command.RunE = func(c *cobra.Command, args []string) (err error) {
         if len(args) < 1 {
             return fmt.Errorf("invalid usage. expecting:[proxy-port:target-host:target:port]+")
         }
+        if err := cmd.ValidateTransport(o.Transport); err != nil {
+            return err
+        }
         for _, arg := range args {
             proxy, err := cmd.ParseProxySpec(arg)
             if err != nil {
@@ -64,23 +66,64 @@ func New() *cobra.Command {
             }
             o.Proxies = append(o.Proxies, proxy)
         }
+        for _, arg := range reverseProxies {
+            proxy, err := cmd.ParseReverseProxySpec(arg)
+            if err != nil {
+                return err
+            }
+            o.ReverseProxies = append(o.ReverseProxies, proxy)
+        }
         utils.ExitOnError(ConfigFiles(o))
         return nil
     }
     return command
 }
 
+// AddClusterFlags adds the flags used to connect to the cluster.
+func AddClusterFlags(command *cobra.Command, o *Options) {
+    // Lets rexport the flags installed by the controller runtime, and make them a little less kube specific
+    f := *flag.CommandLine.Lookup("kubeconfig")
+    f.Name = "config"
+    f.Usage = "path to the config file to connect to the cluster"
+    command.PersistentFlags().AddGoFlag(&f)
+
+    f = *flag.CommandLine.Lookup("master")
+    f.Usage = "the address of the cluster API server."
+    command.PersistentFlags().AddGoFlag(&f)
+
+    // cmd.PersistentFlags().StringVar(&options.KubeConfig, "config", , "path to the config file to connect to the cluster")
+    namespace, _ := GetClientNamespace(o.KubeConfig)
+    command.PersistentFlags().StringVarP(&o.Namespace, "namespace", "n", namespace, "namespace to run against")
+}
+
 type Options struct {
     KubeConfig string
     Namespace  string
 
-    KeySize  int
-    Duration time.Duration
-    Prefix   string
-    Kinds    []string
+    KeyType     string
+    KeySize     int
+    HostKeyType string
+    Duration    time.Duration
+    Prefix      string
+    CAFile      string
+    Kinds       []string
+
+    // CACertFile and CAKeyFile select a CA to sign from instead of the one in
+    // CAFile.  The certificate files supply existing certificates that are
+    // verified against CACertFile instead of issuing new ones.
+    CACertFile       string
+    CAKeyFile        string
+    ImporterCertFile string
+    ImporterKeyFile  string
+    ExporterCertFile string
+    ExporterKeyFile  string
 
+    Transport        string
     ImporterHostPort string
+    ExporterProxy    string
+    UpstreamProxy    string
     Proxies          []cmd.ProxySpec
+    ReverseProxies   []cmd.ReverseProxySpec
 }
 
 type RenderScope struct {
@@ -91,83 +134,247 @@ type RenderScope struct {
 }
 
 func ConfigFiles(o Options) (err error) {
-    outputKinds := map[string]bool{}
-    for _, value := range o.Kinds {
-        outputKinds[strings.ToLower(value)] = true
-    }
     ic := cmd.ImporterConfig{
-        Listen:   "0.0.0.0:1443",
-        Services: o.Proxies,
+        Listen:    "0.0.0.0:1443",
+        Transport: o.Transport,
+        Services:  importerServices(o.Proxies),
+    }
+    for _, proxy := range o.ReverseProxies {
+        ic.ReverseServices = append(ic.ReverseServices, proxy.Target())
     }
     ec := cmd.ExporterConfig{
         ImporterHostPort: o.ImporterHostPort,
+        Transport:        o.Transport,
+        ImporterProxy:    o.ExporterProxy,
+        UpstreamProxy:    o.UpstreamProxy,
         Proxies:          o.Proxies,
+        ReverseProxies:   o.ReverseProxies,
     }
 
-    scope := RenderScope{
-        ImporterConfig: &ic,
-        ExporterConfig: &ec,
+    if o.ImporterCertFile != "" || o.ImporterKeyFile != "" || o.ExporterCertFile != "" || o.ExporterKeyFile != "" {
+        err = useSuppliedCertificates(o, &ic, &ec)
+    } else {
+        err = issueCertificates(o, &ic, &ec)
+    }
+    if err != nil {
+        return err
     }
 
-    ic.Cert, ic.Key, err = createCertificate(o.KeySize, o.Duration, "importer")
+    ic.HostKey, ec.ImporterHostKey, err = createHostKey(o.HostKeyType, o.KeySize)
     if err != nil {
         return err
     }
-    ec.Cert, ec.Key, err = createCertificate(o.KeySize, o.Duration, "exporter")
+
+    err = ImporterConfigFiles(o.Prefix, o.Kinds, &ic)
     if err != nil {
         return err
     }
-    ic.CAs = []string{ec.Cert}
-    ec.CAs = []string{ic.Cert}
 
-    icm, err := yaml.Marshal(ic)
+    err = ExporterConfigFiles(o.Prefix, o.Kinds, &ec)
     if err != nil {
         return err
     }
-    scope.ImporterConfigBase64 = base64.StdEncoding.EncodeToString(icm)
-    ecm, err := yaml.Marshal(ec)
+
+    fmt.Println("")
+    fmt.Println("These files contain secrets.  Please be careful sharing them.")
+
+    return nil
+}
+
+// DefaultImporterIdentity is the common name of the importer certificates issued
+// by install.
+const DefaultImporterIdentity = "importer"
+
+// ImporterIdentity is the identity the exporters expect the importer certificate
+// to have: its common name, or its first DNS name when it has none.
+func ImporterIdentity(cert *x509.Certificate) (string, error) {
+    if cert.Subject.CommonName != "" {
+        return cert.Subject.CommonName, nil
+    }
+    if len(cert.DNSNames) > 0 {
+        return cert.DNSNames[0], nil
+    }
+    return "", fmt.Errorf("it does not have a common name or DNS name")
+}
+
+// issueCertificates issues the importer and exporter certificates with the CA.
+func issueCertificates(o Options, ic *cmd.ImporterConfig, ec *cmd.ExporterConfig) (err error) {
+    ca, err := loadOrCreateCA(o)
+    if err != nil {
+        return err
+    }
+    ic.Cert, ic.Key, err = ca.Issue(o.KeyType, o.KeySize, o.Duration, DefaultImporterIdentity, x509.ExtKeyUsageServerAuth)
+    if err != nil {
+        return err
+    }
+    ec.ImporterIdentity = DefaultImporterIdentity
+    ec.Cert, ec.Key, err = ca.Issue(o.KeyType, o.KeySize, o.Duration, "exporter", x509.ExtKeyUsageClientAuth)
+    if err != nil {
+        return err
+    }
+    ic.CAs = []string{ca.CertPEM}
+    ec.CAs = []string{ca.CertPEM}
+    return nil
+}
+
+// useSuppliedCertificates embeds the importer and exporter certificates that were
+// issued by another PKI once they are verified against its CA.
+func useSuppliedCertificates(o Options, ic *cmd.ImporterConfig, ec *cmd.ExporterConfig) (err error) {
+    if o.ImporterCertFile == "" || o.ImporterKeyFile == "" || o.ExporterCertFile == "" || o.ExporterKeyFile == "" {
+        return fmt.Errorf("the --importer-cert, --importer-key, --exporter-cert and --exporter-key options have to be used together")
+    }
+    if o.CACertFile == "" {
+        return fmt.Errorf("the --ca-cert option is required to verify the supplied certificates")
+    }
+    if o.CAKeyFile != "" {
+        return fmt.Errorf("the --ca-key option can not be used with supplied certificates")
+    }
+    caCerts, err := readFile(o.CACertFile)
+    if err != nil {
+        return err
+    }
+    cas := []string{caCerts}
+    if ic.Cert, err = readFile(o.ImporterCertFile); err != nil {
+        return err
+    }
+    if ic.Key, err = readFile(o.ImporterKeyFile); err != nil {
+        return err
+    }
+    if ec.Cert, err = readFile(o.ExporterCertFile); err != nil {
+        return err
+    }
+    if ec.Key, err = readFile(o.ExporterKeyFile); err != nil {
+        return err
+    }
+
+    importerCert, err := pki.ValidateCertificate(ic.Cert, ic.Key, cas, x509.ExtKeyUsageServerAuth)
+    if err != nil {
+        return fmt.Errorf("invalid importer certificate %s: %v", o.ImporterCertFile, err)
+    }
+    _, err = pki.ValidateCertificate(ec.Cert, ec.Key, cas, x509.ExtKeyUsageClientAuth)
+    if err != nil {
+        return fmt.Errorf("invalid exporter certificate %s: %v", o.ExporterCertFile, err)
+    }
+
+    ec.ImporterIdentity, err = ImporterIdentity(importerCert)
+    if err != nil {
+        return fmt.Errorf("invalid importer certificate %s: %v", o.ImporterCertFile, err)
+    }
+    ic.CAs = cas
+    ec.CAs = cas
+    return nil
+}
+
+// ImporterConfigFiles writes the standalone and/or openshift importer configs
+// selected by kinds.
+func ImporterConfigFiles(prefix string, kinds []string, ic *cmd.ImporterConfig) error {
+    outputKinds := map[string]bool{}
+    for _, value := range kinds {
+        outputKinds[strings.ToLower(value)] = true
+    }
+    icm, err := yaml.Marshal(ic)
     if err != nil {
         return err
     }
-    scope.ExporterConfigBase64 = base64.StdEncoding.EncodeToString(ecm)
 
     if outputKinds["standalone"] {
-        err = writeFile(o.Prefix+"standalone-importer.yaml", icm)
+        err = writeFile(prefix+"standalone-importer.yaml", icm)
         if err != nil {
             return err
         }
+    }
 
-        err = writeFile(o.Prefix+"standalone-exporter.yaml", ecm)
+    if outputKinds["openshift"] {
+        resources, err := RenderImporter(ic)
         if err != nil {
             return err
         }
-
-    }
-
-    if outputKinds["openshift"] {
-        resources, err := Render(importerOpenshiftTemplate, scope)
+        err = writeFile(prefix+"openshift-importer.yaml", []byte(resources))
         if err != nil {
             return err
         }
-        err = writeFile(o.Prefix+"openshift-importer.yaml", []byte(resources))
+    }
+    return nil
+}
+
+// RenderImporter renders the openshift resources of the importer.
+func RenderImporter(ic *cmd.ImporterConfig) (string, error) {
+    icm, err := yaml.Marshal(ic)
+    if err != nil {
+        return "", err
+    }
+    return Render(importerOpenshiftTemplate, RenderScope{
+        ImporterConfig:       ic,
+        ImporterConfigBase64: base64.StdEncoding.EncodeToString(icm),
+    })
+}
+
+// RenderExporter renders the openshift resources of the exporter.
+func RenderExporter(ec *cmd.ExporterConfig) (string, error) {
+    ecm, err := yaml.Marshal(ec)
+    if err != nil {
+        return "", err
+    }
+    return Render(exporterOpenshiftTemplate, RenderScope{
+        ExporterConfig:       ec,
+        ExporterConfigBase64: base64.StdEncoding.EncodeToString(ecm),
+    })
+}
+
+// ExporterConfigFiles writes the standalone and/or openshift exporter configs
+// selected by kinds.
+func ExporterConfigFiles(prefix string, kinds []string, ec *cmd.ExporterConfig) error {
+    outputKinds := map[string]bool{}
+    for _, value := range kinds {
+        outputKinds[strings.ToLower(value)] = true
+    }
+    ecm, err := yaml.Marshal(ec)
+    if err != nil {
+        return err
+    }
+
+    if outputKinds["standalone"] {
+        err = writeFile(prefix+"standalone-exporter.yaml", ecm)
         if err != nil {
             return err
         }
+    }
 
-        resources, err = Render(exporterOpenshiftTemplate, scope)
+    if outputKinds["openshift"] {
+        resources, err := RenderExporter(ec)
         if err != nil {
             return err
         }
-        err = writeFile(o.Prefix+"openshift-exporter.yaml", []byte(resources))
+        err = writeFile(prefix+"openshift-exporter.yaml", []byte(resources))
         if err != nil {
             return err
         }
     }
+    return nil
+}
 
-    fmt.Println("")
-    fmt.Println("These files contain secrets.  Please be careful sharing them.")
+// importerServices fills in the listen address of every service so that the
+// generated kube resources can target the ports the importer will use.
+func importerServices(proxies []cmd.ProxySpec) []cmd.ProxySpec {
+    services := make([]cmd.ProxySpec, len(proxies))
+    copy(services, proxies)
+    for i := range services {
+        if services[i].ListenPath != "" {
+            continue
+        }
+        if services[i].ListenHost == "" {
+            services[i].ListenHost = cmd.DefaultServiceListenHost
+        }
+        if services[i].ListenPort == 0 {
+            services[i].ListenPort = cmd.DefaultServicePortBase + uint32(i)
+        }
+    }
+    return services
+}
 
-    return nil
+func readFile(name string) (string, error) {
+    data, err := ioutil.ReadFile(name)
+    return string(data), err
 }
 
 func writeFile(name string, data []byte) error {
@@ -197,42 +404,104 @@ func Render(goTemplate string, scope interface{}) (string, error) {
     return s, nil
 }
 
-func createCertificate(keySize int, duration time.Duration, commonName string) (publicCert string, privateKey string, err error) {
-    priv, err := rsa.GenerateKey(rand.Reader, keySize)
+// LoadCAConfigFile reads the CA file written by install.
+func LoadCAConfigFile(caFile string) (*cmd.CAConfig, error) {
+    data, err := ioutil.ReadFile(caFile)
+    if err != nil {
+        return nil, err
+    }
+    caConfig := &cmd.CAConfig{}
+    if err := yaml.Unmarshal(data, caConfig); err != nil {
+        return nil, fmt.Errorf("invalid CA file %s: %v", caFile, err)
+    }
+    return caConfig, nil
+}
+
+// WriteCAConfigFile writes the CA file.
+func WriteCAConfigFile(caFile string, caConfig *cmd.CAConfig) error {
+    data, err := yaml.Marshal(caConfig)
     if err != nil {
-        return "", "", fmt.Errorf("failed to generate private key: %s", err)
+        return err
     }
-    notBefore := time.Now()
-    notAfter := notBefore.Add(duration)
-    serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+    return writeFile(caFile, data)
+}
+
+// LoadCAFile loads the CA written by install.
+func LoadCAFile(caFile string) (*pki.CA, error) {
+    caConfig, err := LoadCAConfigFile(caFile)
     if err != nil {
-        log.Fatalf("failed to generate serial number: %s", err)
+        return nil, err
     }
-    template := x509.Certificate{
-        SerialNumber: serialNumber,
-        Subject: pkix.Name{
-            Organization: []string{"localhost"},
-            CommonName:   commonName,
-        },
-        NotBefore:             notBefore,
-        NotAfter:              notAfter,
-        IsCA:                  true,
-        KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
-        ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
-        BasicConstraintsValid: true,
-        DNSNames:              []string{commonName},
-    }
-    derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
-    if err != nil {
-        log.Fatalf("Failed to create certificate: %s", err)
-    }
-    certOut := bytes.NewBuffer(nil)
-    pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
-    cert := certOut.String()
-    keyOut := bytes.NewBuffer(nil)
-    pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
-    key := keyOut.String()
-    return cert, key, nil
+    return pki.LoadCA(caConfig.Cert, caConfig.Key)
+}
+
+// loadOrCreateCA loads the CA from the CA file, or creates the CA and writes it
+// to the CA file if the file does not exist yet.
+func loadOrCreateCA(o Options) (*pki.CA, error) {
+    if o.CAKeyFile != "" || o.CACertFile != "" {
+        if o.CAKeyFile == "" || o.CACertFile == "" {
+            return nil, fmt.Errorf("the --ca-cert and --ca-key options have to be used together to sign from a CA")
+        }
+        certPEM, err := readFile(o.CACertFile)
+        if err != nil {
+            return nil, err
+        }
+        keyPEM, err := readFile(o.CAKeyFile)
+        if err != nil {
+            return nil, err
+        }
+        fmt.Println("using CA: ", o.CACertFile)
+        return pki.LoadCA(certPEM, keyPEM)
+    }
+    caFile := o.CAFile
+    if caFile == "" {
+        caFile = o.Prefix + "ca.yaml"
+    }
+    ca, err := LoadCAFile(caFile)
+    if err == nil {
+        fmt.Println("using CA: ", caFile)
+        return ca, nil
+    }
+    if !os.IsNotExist(err) {
+        return nil, err
+    }
+
+    ca, err = pki.NewCA(o.KeyType, o.KeySize, o.Duration, "svcteleporter-ca")
+    if err != nil {
+        return nil, err
+    }
+    if err := WriteCAConfigFile(caFile, &cmd.CAConfig{Cert: ca.CertPEM, Key: ca.KeyPEM}); err != nil {
+        return nil, err
+    }
+    return ca, nil
+}
+
+// createHostKey generates the ssh host key of the importer.  It returns the PEM
+// encoded private key and the public key in authorized_keys format.
+func createHostKey(keyType string, keySize int) (privateKey string, publicKey string, err error) {
+    switch keyType {
+    case "", "ed25519":
+        keyType = pki.KeyTypeEd25519
+    case "ecdsa":
+        keyType = pki.KeyTypeECDSAP256
+    case "rsa":
+        keyType = pki.KeyTypeRSA
+    default:
+        return "", "", fmt.Errorf("invalid host key type '%s', expecting one of: ed25519, ecdsa, rsa", keyType)
+    }
+    priv, err := pki.GenerateKey(keyType, keySize)
+    if err != nil {
+        return "", "", fmt.Errorf("failed to generate host key: %s", err)
+    }
+    sshPublicKey, err := ssh.NewPublicKey(priv.Public())
+    if err != nil {
+        return "", "", err
+    }
+    privateKey, err = pki.EncodeKey(priv)
+    if err != nil {
+        return "", "", err
+    }
+    return privateKey, strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublicKey))), nil
 }
 
 func (o *Options) GetClientConfig() *rest.Config {
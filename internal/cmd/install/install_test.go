@@ -0,0 +1,191 @@
+package install
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/chirino/svcteleporter/internal/pkg/pki"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/yaml"
+)
+
+func TestConfigFilesWithSuppliedCertificates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svcteleporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, err := pki.NewCA(pki.KeyTypeECDSAP256, 0, time.Hour, "corporate-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{"ca.pem": ca.CertPEM}
+	files["importer.pem"], files["importer-key.pem"], err = ca.Issue(pki.KeyTypeECDSAP256, 0, time.Hour, "teleporter.example.com", x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files["exporter.pem"], files["exporter-key.pem"], err = ca.Issue(pki.KeyTypeECDSAP256, 0, time.Hour, "site-a", x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	o := Options{
+		Kinds:            []string{"standalone"},
+		HostKeyType:      "ed25519",
+		Prefix:           filepath.Join(dir, "byo-"),
+		CACertFile:       filepath.Join(dir, "ca.pem"),
+		ImporterCertFile: filepath.Join(dir, "importer.pem"),
+		ImporterKeyFile:  filepath.Join(dir, "importer-key.pem"),
+		ExporterCertFile: filepath.Join(dir, "exporter.pem"),
+		ExporterKeyFile:  filepath.Join(dir, "exporter-key.pem"),
+		ImporterHostPort: "teleporter.example.com:443",
+		Proxies:          []cmd.ProxySpec{{KubeService: "db", KubePort: 5432, UpstreamHost: "db.local", UpstreamPort: 5432}},
+	}
+	if err := ConfigFiles(o); err != nil {
+		t.Fatal(err)
+	}
+	ec := cmd.ExporterConfig{}
+	loadConfig(t, o.Prefix+"standalone-exporter.yaml", &ec)
+	assert.Equal(t, "teleporter.example.com", ec.ImporterIdentity)
+	assert.Equal(t, files["exporter.pem"], ec.Cert)
+	assert.Equal(t, []string{ca.CertPEM}, ec.CAs)
+	ic := cmd.ImporterConfig{}
+	loadConfig(t, o.Prefix+"standalone-importer.yaml", &ic)
+	assert.Equal(t, files["importer.pem"], ic.Cert)
+	assert.Equal(t, []string{ca.CertPEM}, ic.CAs)
+	_, err = os.Stat(o.Prefix + "ca.yaml")
+	assert.True(t, os.IsNotExist(err), "no CA file should be written")
+
+	// The certificates have to be used for the right side of the connection.
+	swapped := o
+	swapped.ImporterCertFile, swapped.ExporterCertFile = o.ExporterCertFile, o.ImporterCertFile
+	swapped.ImporterKeyFile, swapped.ExporterKeyFile = o.ExporterKeyFile, o.ImporterKeyFile
+	err = ConfigFiles(swapped)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "is not valid for server authentication")
+
+	missing := o
+	missing.ExporterKeyFile = ""
+	assert.Error(t, ConfigFiles(missing))
+
+	untrusted := o
+	otherCA, err := pki.NewCA(pki.KeyTypeECDSAP256, 0, time.Hour, "other-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	untrusted.CACertFile = filepath.Join(dir, "other-ca.pem")
+	if err := ioutil.WriteFile(untrusted.CACertFile, []byte(otherCA.CertPEM), 0600); err != nil {
+		t.Fatal(err)
+	}
+	err = ConfigFiles(untrusted)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "is not trusted by the CA")
+}
+
+func TestConfigFilesSignedBySuppliedCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svcteleporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, err := pki.NewCA(pki.KeyTypeECDSAP256, 0, time.Hour, "corporate-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := Options{
+		Kinds:            []string{"standalone"},
+		KeyType:          pki.KeyTypeEd25519,
+		Duration:         time.Hour,
+		Prefix:           filepath.Join(dir, "signed-"),
+		CACertFile:       filepath.Join(dir, "ca.pem"),
+		CAKeyFile:        filepath.Join(dir, "ca-key.pem"),
+		ImporterHostPort: "teleporter.example.com:443",
+		Proxies:          []cmd.ProxySpec{{KubeService: "db", KubePort: 5432, UpstreamHost: "db.local", UpstreamPort: 5432}},
+	}
+	if err := ioutil.WriteFile(o.CACertFile, []byte(ca.CertPEM), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(o.CAKeyFile, []byte(ca.KeyPEM), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ConfigFiles(o); err != nil {
+		t.Fatal(err)
+	}
+
+	ec := cmd.ExporterConfig{}
+	loadConfig(t, o.Prefix+"standalone-exporter.yaml", &ec)
+	assert.Equal(t, []string{ca.CertPEM}, ec.CAs)
+	_, err = pki.ValidateCertificate(ec.Cert, ec.Key, ec.CAs, x509.ExtKeyUsageClientAuth)
+	assert.NoError(t, err)
+	_, err = os.Stat(o.Prefix + "ca.yaml")
+	assert.True(t, os.IsNotExist(err), "the supplied CA should not be copied to a CA file")
+
+	o.CAKeyFile = ""
+	assert.Error(t, ConfigFiles(o))
+}
+
+func loadConfig(t *testing.T, file string, config interface{}) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenderedDeploymentsHaveProbes(t *testing.T) {
+	importer, err := RenderImporter(&cmd.ImporterConfig{Services: []cmd.ProxySpec{{KubeService: "a", KubePort: 80, ListenPort: 2000}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	exporter, err := RenderExporter(&cmd.ExporterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rendered := range []string{importer, exporter} {
+		list := struct {
+			Items []struct {
+				Kind string
+				Spec struct {
+					Template struct {
+						Spec struct {
+							Containers []struct {
+								Command        []string
+								LivenessProbe  map[string]interface{}
+								ReadinessProbe map[string]interface{}
+							}
+						}
+					}
+				}
+			}
+		}{}
+		if err := yaml.Unmarshal([]byte(rendered), &list); err != nil {
+			t.Fatal(err)
+		}
+		deployments := 0
+		for _, item := range list.Items {
+			if item.Kind != "Deployment" {
+				continue
+			}
+			deployments++
+			container := item.Spec.Template.Spec.Containers[0]
+			assert.Contains(t, container.Command, "--health-listen")
+			assert.Equal(t, "/healthz", container.LivenessProbe["httpGet"].(map[string]interface{})["path"])
+			assert.Equal(t, "/readyz", container.ReadinessProbe["httpGet"].(map[string]interface{})["path"])
+		}
+		assert.Equal(t, 1, deployments)
+	}
+}
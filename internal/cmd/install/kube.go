@@ -49,7 +49,7 @@ func InstallImporterIntoOpenshift(o Options, scope RenderScope) error {
 	case []interface{}:
 		for _, value := range v {
 			if x, ok := value.(map[string]interface{}); ok {
-				resouce := unstructured.Unstructured{x}
+				resouce := unstructured.Unstructured{Object: x}
 				_, _, err := CreateOrUpdate(context.Background(), client, &resouce)
 				if err != nil {
 					return err
@@ -63,6 +63,35 @@ func InstallImporterIntoOpenshift(o Options, scope RenderScope) error {
 	return nil
 }
 
+// ApplySecrets creates or updates the Secrets found in the rendered resources in
+// the namespace of the options.
+func ApplySecrets(o Options, resources string) error {
+	list := map[string]interface{}{}
+	err := yaml.Unmarshal([]byte(resources), &list)
+	if err != nil {
+		return err
+	}
+	items, _ := list["items"].([]interface{})
+
+	client, err := o.GetClient()
+	if err != nil {
+		return err
+	}
+	for _, item := range items {
+		x, ok := item.(map[string]interface{})
+		if !ok || x["kind"] != "Secret" {
+			continue
+		}
+		secret := unstructured.Unstructured{Object: x}
+		secret.SetNamespace(o.Namespace)
+		_, result, err := CreateOrUpdate(context.Background(), client, &secret)
+		if err != nil {
+			return err
+		}
+		fmt.Println("secret", secret.GetName(), result)
+	}
+	return nil
+}
 
 func GetClientNamespace(configPath string) (string, error) {
 	var clientConfig clientcmd.ClientConfig
@@ -99,7 +128,7 @@ func ToUnstructured(obj runtime.Object) (*unstructured.Unstructured, error) {
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
-	return &unstructured.Unstructured{fields}, nil
+	return &unstructured.Unstructured{Object: fields}, nil
 }
 
 func CreateOrUpdate(ctx context.Context, cl client.Client, o runtime.Object, skipFields ...string) (*unstructured.Unstructured, controllerutil.OperationResult, error) {
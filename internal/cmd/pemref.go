@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Prefixes of the Cert, Key and CAs config values that reference their PEM data
+// instead of holding it inline.
+const (
+	// FileRefPrefix references a file.  When the file is a directory, like a
+	// mounted kube TLS Secret, the TLSCertFile, TLSKeyFile or CACertFile in it is
+	// read depending on the field.
+	FileRefPrefix = "file:"
+	// EnvRefPrefix references an environment variable.
+	EnvRefPrefix = "env:"
+)
+
+// The files read from a directory reference.  They match the keys of the kube
+// TLS Secrets created by cert-manager.
+const (
+	TLSCertFile = "tls.crt"
+	TLSKeyFile  = "tls.key"
+	CACertFile  = "ca.crt"
+)
+
+// IsPEMRef reports if the config value references its PEM data.
+func IsPEMRef(value string) bool {
+	return strings.HasPrefix(value, FileRefPrefix) || strings.HasPrefix(value, EnvRefPrefix)
+}
+
+// refFile returns the file a file reference points to.  dirFile is the file used
+// when the reference points to a directory.
+func refFile(value string, dirFile string) string {
+	file := strings.TrimPrefix(value, FileRefPrefix)
+	if info, err := os.Stat(file); err == nil && info.IsDir() {
+		return filepath.Join(file, dirFile)
+	}
+	return file
+}
+
+// ResolvePEM returns the PEM data of a config value, reading it from the file or
+// environment variable the value references.
+func ResolvePEM(value string, dirFile string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, FileRefPrefix):
+		data, err := ioutil.ReadFile(refFile(value, dirFile))
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	case strings.HasPrefix(value, EnvRefPrefix):
+		name := strings.TrimPrefix(value, EnvRefPrefix)
+		data := os.Getenv(name)
+		if data == "" {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return data, nil
+	}
+	return value, nil
+}
+
+func resolveTLS(cert string, key string, cas []string) (string, string, []string, error) {
+	cert, err := ResolvePEM(cert, TLSCertFile)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("could not load the Cert: %v", err)
+	}
+	key, err = ResolvePEM(key, TLSKeyFile)
+	if err != nil {
+		return "", "", nil, fmt.Errorf("could not load the Key: %v", err)
+	}
+	resolved := make([]string, len(cas))
+	for i, ca := range cas {
+		resolved[i], err = ResolvePEM(ca, CACertFile)
+		if err != nil {
+			return "", "", nil, fmt.Errorf("could not load the CAs: %v", err)
+		}
+	}
+	return cert, key, resolved, nil
+}
+
+func tlsFiles(cert string, key string, cas []string) []string {
+	files := []string{}
+	add := func(value string, dirFile string) {
+		if strings.HasPrefix(value, FileRefPrefix) {
+			files = append(files, refFile(value, dirFile))
+		}
+	}
+	add(cert, TLSCertFile)
+	add(key, TLSKeyFile)
+	for _, ca := range cas {
+		add(ca, CACertFile)
+	}
+	return files
+}
+
+// ResolveTLS returns a copy of the config with the PEM data of the Cert, Key and
+// CAs references loaded.
+func (c *ImporterConfig) ResolveTLS() (*ImporterConfig, error) {
+	resolved := *c
+	var err error
+	resolved.Cert, resolved.Key, resolved.CAs, err = resolveTLS(c.Cert, c.Key, c.CAs)
+	if err != nil {
+		return nil, err
+	}
+	return &resolved, nil
+}
+
+// TLSFiles lists the files referenced by the Cert, Key and CAs.
+func (c *ImporterConfig) TLSFiles() []string {
+	return tlsFiles(c.Cert, c.Key, c.CAs)
+}
+
+// ResolveTLS returns a copy of the config with the PEM data of the Cert, Key and
+// CAs references loaded.
+func (c *ExporterConfig) ResolveTLS() (*ExporterConfig, error) {
+	resolved := *c
+	var err error
+	resolved.Cert, resolved.Key, resolved.CAs, err = resolveTLS(c.Cert, c.Key, c.CAs)
+	if err != nil {
+		return nil, err
+	}
+	return &resolved, nil
+}
+
+// TLSFiles lists the files referenced by the Cert, Key and CAs.
+func (c *ExporterConfig) TLSFiles() []string {
+	return tlsFiles(c.Cert, c.Key, c.CAs)
+}
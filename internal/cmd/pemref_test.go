@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svcteleporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, data := range map[string]string{TLSCertFile: "cert", TLSKeyFile: "key", CACertFile: "ca", "other-ca.pem": "other-ca"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Setenv("SVCTELEPORTER_TEST_KEY", "env-key")
+	defer os.Unsetenv("SVCTELEPORTER_TEST_KEY")
+
+	config := &ExporterConfig{
+		Cert: "file:" + dir,
+		Key:  "env:SVCTELEPORTER_TEST_KEY",
+		CAs:  []string{"file:" + dir, "file:" + filepath.Join(dir, "other-ca.pem"), "inline"},
+	}
+	resolved, err := config.ResolveTLS()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "cert", resolved.Cert)
+		assert.Equal(t, "env-key", resolved.Key)
+		assert.Equal(t, []string{"ca", "other-ca", "inline"}, resolved.CAs)
+	}
+	assert.Equal(t, "file:"+dir, config.Cert, "the config keeps its references")
+	assert.Equal(t, []string{
+		filepath.Join(dir, TLSCertFile),
+		filepath.Join(dir, CACertFile),
+		filepath.Join(dir, "other-ca.pem"),
+	}, config.TLSFiles())
+
+	_, err = (&ImporterConfig{Key: "env:SVCTELEPORTER_TEST_MISSING"}).ResolveTLS()
+	assert.EqualError(t, err, "could not load the Key: environment variable SVCTELEPORTER_TEST_MISSING is not set")
+	_, err = (&ImporterConfig{CAs: []string{"file:" + filepath.Join(dir, "missing")}}).ResolveTLS()
+	assert.Error(t, err)
+}
+
+func TestWatchFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svcteleporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, TLSCertFile)
+	if err := ioutil.WriteFile(file, []byte("first"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(interval time.Duration) { ConfigPollInterval = interval }(ConfigPollInterval)
+	ConfigPollInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var changes int32
+	go WatchFiles(ctx, func() []string { return []string{file} }, func() {
+		atomic.AddInt32(&changes, 1)
+	})
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&changes))
+	if err := ioutil.WriteFile(file, []byte("second"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&changes))
+}
+
+func TestWatchFilesChangedDuringReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svcteleporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, TLSCertFile)
+	if err := ioutil.WriteFile(file, []byte("first"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func(interval time.Duration) { ConfigPollInterval = interval }(ConfigPollInterval)
+	ConfigPollInterval = 10 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var changes int32
+	go WatchFiles(ctx, func() []string { return []string{file} }, func() {
+		// The file changes again while the first change is applied.
+		if atomic.AddInt32(&changes, 1) == 1 {
+			ioutil.WriteFile(file, []byte("third"), 0600)
+		}
+	})
+
+	time.Sleep(50 * time.Millisecond)
+	if err := ioutil.WriteFile(file, []byte("second"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&changes))
+}
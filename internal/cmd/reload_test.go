@@ -0,0 +1,92 @@
+package cmd_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/chirino/svcteleporter/internal/cmd/exporter"
+	"github.com/chirino/svcteleporter/internal/cmd/install"
+	"github.com/stretchr/testify/assert"
+	"sigs.k8s.io/yaml"
+)
+
+func TestHotReload(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	serviceA := echoService(t)
+	defer serviceA.Close()
+	serviceB := echoService(t)
+	defer serviceB.Close()
+	a := echoProxy(t, "a", serviceA)
+	b := echoProxy(t, "b", serviceB)
+
+	f := newFixture(t, install.Options{Proxies: []cmd.ProxySpec{a}})
+	defer f.Close()
+	imp, _ := f.startImporter(ctx)
+	go exporter.ServeConfigFile(ctx, f.ExporterFile)
+
+	established := dialEcho(t, address(a))
+	defer established.Close()
+
+	// Add service b to both sides.
+	changedImporter := *f.ImporterConfig
+	changedImporter.Services = []cmd.ProxySpec{a, b}
+	FatalOnError(t, imp.Reload(&changedImporter))
+	exporterConfig := *f.ExporterConfig
+	exporterConfig.Proxies = []cmd.ProxySpec{a, b}
+	data, err := yaml.Marshal(exporterConfig)
+	FatalOnError(t, err)
+	FatalOnError(t, ioutil.WriteFile(f.ExporterFile, data, 0600))
+
+	connB := dialEcho(t, address(b))
+	connB.Close()
+	assert.True(t, echoes(established, "still there"), "the connection of the unchanged service should not be affected")
+
+	// Remove service a from the importer.
+	changedImporter.Services = []cmd.ProxySpec{b}
+	FatalOnError(t, imp.Reload(&changedImporter))
+	_, err = net.Dial("tcp", address(a))
+	assert.Error(t, err, "the listener of the removed service should be closed")
+	connB = dialEcho(t, address(b))
+	connB.Close()
+}
+
+func TestReloadKeepsDefaultPorts(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	upstream := echoService(t)
+	defer upstream.Close()
+	a := echoProxy(t, "a", upstream)
+	b := echoProxy(t, "b", upstream)
+	f := newFixture(t, install.Options{Proxies: []cmd.ProxySpec{a, b}})
+	defer f.Close()
+	// Both services listen on the ports that follow the ServicePortBase.
+	base := freePort(t)
+	f.ImporterConfig.ServicePortBase = base
+	for i := range f.ImporterConfig.Services {
+		f.ImporterConfig.Services[i].ListenPort = 0
+	}
+	b = f.ImporterConfig.Services[1]
+	imp, _ := f.startImporter(ctx)
+	f.startExporter(ctx)
+
+	addressB := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(base+1)))
+	established := dialEcho(t, addressB)
+	defer established.Close()
+
+	// Removing the first service should not move the second one to its port.
+	changedImporter := *f.ImporterConfig
+	changedImporter.Services = []cmd.ProxySpec{b}
+	FatalOnError(t, imp.Reload(&changedImporter))
+	conn := dialEcho(t, addressB)
+	conn.Close()
+	assert.True(t, echoes(established, "still there"), "the connection of the unchanged service should not be affected")
+	_, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(base))))
+	assert.Error(t, err, "the listener of the removed service should be closed")
+}
@@ -0,0 +1,66 @@
+package cmd_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/chirino/svcteleporter/internal/cmd"
+	"github.com/chirino/svcteleporter/internal/cmd/install"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGracefulShutdown(t *testing.T) {
+	upstream := echoService(t)
+	defer upstream.Close()
+	service := echoProxy(t, "a", upstream)
+	f := newFixture(t, install.Options{Proxies: []cmd.ProxySpec{service}})
+	defer f.Close()
+
+	importerCtx, cancelImporter := context.WithCancel(context.Background())
+	defer cancelImporter()
+	_, importerDone := f.startImporter(importerCtx)
+	exporterCtx, cancelExporter := context.WithCancel(context.Background())
+	defer cancelExporter()
+	f.ExporterConfig.DrainTimeout = cmd.Duration(10 * time.Second)
+	exporterDone := f.startExporter(exporterCtx)
+
+	established := dialEcho(t, address(service))
+	defer established.Close()
+
+	// The exporter cancels its forward but keeps the established connection.
+	cancelExporter()
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", address(service))
+		if err != nil {
+			break
+		}
+		conn.Close()
+		time.Sleep(100 * time.Millisecond)
+	}
+	_, err := net.Dial("tcp", address(service))
+	assert.Error(t, err, "the service should not accept new connections while shutting down")
+	assert.True(t, echoes(established, "still there"), "the established connection should be drained")
+	select {
+	case <-exporterDone:
+		t.Fatal("the exporter should wait for the established connection to close")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	established.Close()
+	select {
+	case err := <-exporterDone:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the exporter did not shut down once its connections closed")
+	}
+
+	cancelImporter()
+	select {
+	case err := <-importerDone:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the importer did not shut down")
+	}
+}
@@ -0,0 +1,43 @@
+package cmd
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// ShutdownContext returns a context that is canceled when the process receives a
+// SIGTERM or SIGINT so that it can shut down gracefully.  A second signal exits
+// the process right away.
+func ShutdownContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan os.Signal, 2)
+	signal.Notify(ch, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-ch
+		log.Println("received", sig, "signal, shutting down")
+		cancel()
+		<-ch
+		log.Println("received a second signal, exiting")
+		os.Exit(1)
+	}()
+	return ctx
+}
+
+// OnSignal calls fn every time the process receives one of the signals until the
+// context is canceled.
+func OnSignal(ctx context.Context, fn func(), signals ...os.Signal) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, signals...)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+			fn()
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/chirino/svcteleporter/internal/pkg/metrics"
+)
+
+// ReadyFunc reports why the service is not ready to accept connections, or why
+// not all the services are when service is empty.
+type ReadyFunc func(service string) error
+
+// ServeStatus serves the Prometheus metrics on /metrics of metricsListen, and the
+// /healthz, /readyz and /readyz/<service> probes on healthListen, in the
+// background until the context is canceled.  Either address can be empty, and
+// they share a listener when they are the same.
+func ServeStatus(ctx context.Context, metricsListen string, healthListen string, ready ReadyFunc, logPrefix string) error {
+	muxes := map[string]*http.ServeMux{}
+	mux := func(listen string) *http.ServeMux {
+		if muxes[listen] == nil {
+			muxes[listen] = http.NewServeMux()
+		}
+		return muxes[listen]
+	}
+	if metricsListen != "" {
+		mux(metricsListen).Handle("/metrics", metrics.Handler())
+	}
+	if healthListen != "" {
+		healthMux := mux(healthListen)
+		healthMux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintln(w, "ok")
+		})
+		readyz := func(w http.ResponseWriter, r *http.Request) {
+			service := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/readyz"), "/")
+			if err := ready(service); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			fmt.Fprintln(w, "ok")
+		}
+		healthMux.HandleFunc("/readyz", readyz)
+		healthMux.HandleFunc("/readyz/", readyz)
+	}
+
+	listeners := map[string]net.Listener{}
+	for listen := range muxes {
+		listener, err := net.Listen("tcp", listen)
+		if err != nil {
+			for _, listener := range listeners {
+				listener.Close()
+			}
+			return err
+		}
+		listeners[listen] = listener
+	}
+	for listen, listener := range listeners {
+		server := &http.Server{Handler: muxes[listen]}
+		go func() {
+			<-ctx.Done()
+			server.Close()
+		}()
+		log.Println(logPrefix+"serving status endpoints on:", listener.Addr())
+		go func(listener net.Listener) {
+			if err := server.Serve(listener); err != http.ErrServerClosed {
+				log.Println(logPrefix+"status server error:", err)
+			}
+		}(listener)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package svcteleporter
 
 import (
+	"github.com/chirino/svcteleporter/internal/cmd/certs"
 	"github.com/chirino/svcteleporter/internal/cmd/install"
 	"github.com/chirino/svcteleporter/internal/cmd/exporter"
 	"github.com/chirino/svcteleporter/internal/cmd/importer"
@@ -15,6 +16,7 @@ func New() *cobra.Command {
 	}
 	result.AddCommand(importer.New())
 	result.AddCommand(install.New())
+	result.AddCommand(certs.New())
 	result.AddCommand(exporter.New())
 	result.AddCommand(version.New())
 	return result
@@ -4,12 +4,11 @@ import (
 	"context"
 	"github.com/chirino/svcteleporter/internal/cmd"
 	"github.com/chirino/svcteleporter/internal/cmd/install"
+	"github.com/chirino/svcteleporter/internal/pkg/pki"
 	"strconv"
 
 	//"github.com/chirino/svcteleporter/internal/cmd"
 	//"github.com/chirino/svcteleporter/internal/cmd/create"
-	"github.com/chirino/svcteleporter/internal/cmd/exporter"
-	"github.com/chirino/svcteleporter/internal/cmd/importer"
 	"github.com/stretchr/testify/assert"
 	"io/ioutil"
 	"log"
@@ -26,7 +25,31 @@ func FatalOnError(t *testing.T, err error) {
 }
 
 func TestEndToEnd(t *testing.T) {
+	for _, transport := range []string{cmd.TransportTLS, cmd.TransportWSS} {
+		t.Run(transport, func(t *testing.T) {
+			testEndToEnd(t, transport, pki.KeyTypeECDSAP256, 0)
+		})
+	}
+}
+
+func TestKeyTypes(t *testing.T) {
+	for _, keyType := range []string{pki.KeyTypeRSA, pki.KeyTypeECDSAP384, pki.KeyTypeEd25519} {
+		t.Run(keyType, func(t *testing.T) {
+			testEndToEnd(t, cmd.TransportTLS, keyType, 0)
+		})
+	}
+}
+
+func TestExporterReconnects(t *testing.T) {
+	// The importer comes online after the exporter's first connect attempts fail.
+	testEndToEnd(t, cmd.TransportTLS, pki.KeyTypeECDSAP256, 2*time.Second)
+}
+
+func testEndToEnd(t *testing.T, transport string, keyType string, importerDelay time.Duration) {
 	assert := assert.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer waitForPortToClose("localhost:2000")
+	defer cancel()
 
 	log.Println("Opening ports...")
 	// Open the port of a mock service
@@ -34,46 +57,81 @@ func TestEndToEnd(t *testing.T) {
 	FatalOnError(t, err)
 	targetPort, err := strconv.Atoi(getPort(mockSvcListener))
 	FatalOnError(t, err)
-	// Open the port the ssh over ws service.
-	sslListener, err := net.Listen("tcp", "127.0.0.1:0")
+	// and a udp mock service that echos datagrams back
+	mockUDPSvc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	FatalOnError(t, err)
+	defer mockUDPSvc.Close()
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := mockUDPSvc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			mockUDPSvc.WriteTo(buf[:n], addr)
+		}
+	}()
+	// and a cluster service that the exporter brings back with a reverse proxy.
+	clusterSvcListener, err := net.Listen("tcp", "127.0.0.1:0")
+	FatalOnError(t, err)
+	defer clusterSvcListener.Close()
+	clusterSvcPort, err := strconv.Atoi(getPort(clusterSvcListener))
 	FatalOnError(t, err)
+	reverseListener, err := net.Listen("tcp", "127.0.0.1:0")
+	FatalOnError(t, err)
+	reverseAddress := reverseListener.Addr().String()
+	reversePort, err := strconv.Atoi(getPort(reverseListener))
+	FatalOnError(t, err)
+	reverseListener.Close()
 
 	// Now that we know the ports that we will be using.. lets create the config
 	log.Println("Generating certs and config...")
-	err = install.ConfigFiles(install.Options{
-		Kinds:            []string{"standalone"},
-		Duration:         24 * time.Hour,
-		KeySize:          4096,
-		Prefix:           ".test-",
-		ImporterHostPort: "127.0.0.1:" + getPort(sslListener),
+	f := newFixture(t, install.Options{
+		Duration:  24 * time.Hour,
+		KeyType:   keyType,
+		KeySize:   2048,
+		Transport: transport,
 		Proxies: []cmd.ProxySpec{
 			cmd.ProxySpec{
+				KubeService:  "mock",
 				KubePort:     2000,
 				UpstreamHost: "127.0.0.1",
 				UpstreamPort: uint32(targetPort),
 			},
+			cmd.ProxySpec{
+				Protocol:     cmd.ProtocolUDP,
+				KubeService:  "mock-udp",
+				KubePort:     2001,
+				UpstreamHost: "127.0.0.1",
+				UpstreamPort: uint32(mockUDPSvc.LocalAddr().(*net.UDPAddr).Port),
+			},
+		},
+		ReverseProxies: []cmd.ReverseProxySpec{
+			cmd.ReverseProxySpec{
+				KubeService: "127.0.0.1",
+				KubePort:    uint32(clusterSvcPort),
+				ListenHost:  "127.0.0.1",
+				ListenPort:  uint32(reversePort),
+			},
 		},
 	})
-	if err != nil {
-		t.Fatal(err)
-	}
+	defer f.Close()
 
 	// Run the importer...
-	go func() {
-		importerConfig, err := importer.LoadConfigFile(".test-standalone-importer.yaml")
-		FatalOnError(t, err)
-		importer, err := importer.NewFromConfig(context.Background(), importerConfig)
-		FatalOnError(t, err)
-		err = importer.Serve(sslListener)
-		FatalOnError(t, err)
-	}()
+	if importerDelay > 0 {
+		f.Tunnel.Close()
+		go func() {
+			time.Sleep(importerDelay)
+			listener, err := net.Listen("tcp", f.Tunnel.Addr().String())
+			FatalOnError(t, err)
+			f.startImporterOn(ctx, listener)
+		}()
+	} else {
+		f.startImporter(ctx)
+	}
 
 	// Run the exporter...
-	go func() {
-		exporterConfig, err := exporter.LoadConfigFile(".test-standalone-exporter.yaml")
-		FatalOnError(t, err)
-		exporter.Serve(context.Background(), exporterConfig)
-	}()
+	f.startExporter(ctx)
 
 	time.Sleep(1 * time.Second)
 	// Do a request against the importer proxy port..
@@ -109,9 +167,88 @@ func TestEndToEnd(t *testing.T) {
 
 	text := string(data)
 	assert.Equal(`hello!`, text)
+
+	// datagrams sent to the importer should get echoed back by the udp mock service.
+	udpConn, err := net.Dial("udp", "127.0.0.1:2001")
+	FatalOnError(t, err)
+	defer udpConn.Close()
+	reply := make([]byte, 1024)
+	for i := 1; ; i++ {
+		udpConn.Write([]byte(`ping!`))
+		udpConn.SetReadDeadline(time.Now().Add(1 * time.Second))
+		n, err := udpConn.Read(reply)
+		if err == nil {
+			assert.Equal(`ping!`, string(reply[:n]))
+			break
+		}
+		if i >= 10 {
+			t.Fatal(err)
+		}
+		log.Printf("UDP attempt %d error: %s\n", i, err)
+	}
+
+	// connections to the exporter's reverse proxy should reach the cluster service.
+	reverseConn, err := net.Dial("tcp", reverseAddress)
+	FatalOnError(t, err)
+	reverseConn.Write([]byte(`hello cluster!`))
+	reverseConn.Close()
+	conn, err = clusterSvcListener.Accept()
+	FatalOnError(t, err)
+	data, err = ioutil.ReadAll(conn)
+	FatalOnError(t, err)
+	assert.Equal(`hello cluster!`, string(data))
+}
+
+// waitForPortToClose waits for the importer to release a service port so that
+// the next test can reuse it.
+func waitForPortToClose(address string) {
+	for i := 0; i < 50; i++ {
+		conn, err := net.Dial("tcp", address)
+		if err != nil {
+			return
+		}
+		conn.Close()
+		time.Sleep(100 * time.Millisecond)
+	}
 }
 
 func getPort(listener net.Listener) string {
 	addr := strings.Split(listener.Addr().String(), ":")
 	return addr[len(addr)-1]
 }
+
+func TestExporterReconnectsAfterImporterRestart(t *testing.T) {
+	upstream := echoService(t)
+	defer upstream.Close()
+	service := echoProxy(t, "a", upstream)
+	f := newFixture(t, install.Options{Proxies: []cmd.ProxySpec{service}})
+	defer f.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	importerCtx, stopImporter := context.WithCancel(ctx)
+	_, importerDone := f.startImporter(importerCtx)
+	f.startExporter(ctx)
+
+	conn := dialEcho(t, address(service))
+	conn.Close()
+
+	// Stop the importer once traffic flowed and start a new one on the same address.
+	tunnelAddress := f.Tunnel.Addr().String()
+	stopImporter()
+	select {
+	case err := <-importerDone:
+		FatalOnError(t, err)
+	case <-time.After(30 * time.Second):
+		t.Fatal("the importer did not stop")
+	}
+	waitForPortToClose(address(service))
+	var err error
+	f.Tunnel, err = net.Listen("tcp", tunnelAddress)
+	FatalOnError(t, err)
+	f.startImporterOn(ctx, f.Tunnel)
+
+	conn = dialEcho(t, address(service))
+	assert.True(t, echoes(conn, "hello again!"), "traffic should flow once the exporter reconnected")
+	conn.Close()
+}
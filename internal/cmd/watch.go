@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"time"
+)
+
+// ConfigPollInterval is how often the config files and the files they reference
+// are checked for changes.
+var ConfigPollInterval = 10 * time.Second
+
+// WatchFiles calls onChange whenever the contents of the files change.  The files
+// are polled since kube updates mounted Secrets by swapping symlinks, which file
+// change notifications don't report reliably.  files is called on every poll so
+// that the watched files can follow config changes.
+func WatchFiles(ctx context.Context, files func() []string, onChange func()) {
+	last := filesDigest(files())
+	ticker := time.NewTicker(ConfigPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// The digest is taken before onChange so that the changes made while it runs
+		// trigger another call.
+		digest := filesDigest(files())
+		if bytes.Equal(digest, last) {
+			continue
+		}
+		onChange()
+		last = digest
+	}
+}
+
+// filesDigest hashes the names and contents of the files.  Missing files hash as
+// empty files.
+func filesDigest(files []string) []byte {
+	h := sha256.New()
+	for _, file := range files {
+		data, _ := ioutil.ReadFile(file)
+		h.Write([]byte(file))
+		h.Write([]byte{0})
+		h.Write(data)
+		h.Write([]byte{0})
+	}
+	return h.Sum(nil)
+}
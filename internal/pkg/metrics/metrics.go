@@ -0,0 +1,170 @@
+package metrics
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "svcteleporter"
+
+// The directions of the bytes relayed for a connection: In is what the client
+// that opened the connection sends, Out is what it receives.
+const (
+	In  = "in"
+	Out = "out"
+)
+
+var (
+	activeConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "service_active_connections",
+		Help:      "The number of connections of the service being relayed.",
+	}, []string{"service"})
+	connections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "service_connections_total",
+		Help:      "The number of connections of the service relayed so far.",
+	}, []string{"service"})
+	relayedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "service_bytes_total",
+		Help:      "The bytes relayed for the connections of the service, in is what the clients sent and out what they received.",
+	}, []string{"service", "direction"})
+	upstreamDialErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_dial_errors_total",
+		Help:      "The number of failed dials to the upstream of the service.",
+	}, []string{"service"})
+	upstreamDialDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_dial_duration_seconds",
+		Help:      "How long it took to dial the upstream of the service.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"service"})
+	sessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "ssh_sessions",
+		Help:      "The number of ssh sessions that are up between the exporters and the importer.",
+	})
+	tlsHandshakeFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "tls_handshake_failures_total",
+		Help:      "The number of TLS handshakes with the exporters that failed.",
+	})
+	// certificateNotAfter holds the unix time the certificate expires at.
+	certificateNotAfter int64
+	certificateExpiry   = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "certificate_expiry_seconds",
+		Help:      "The seconds until the certificate in use expires.",
+	}, func() float64 {
+		notAfter := atomic.LoadInt64(&certificateNotAfter)
+		if notAfter == 0 {
+			return 0
+		}
+		return time.Until(time.Unix(notAfter, 0)).Seconds()
+	})
+)
+
+// Registry holds the metrics of svcteleporter.
+var Registry = prometheus.NewRegistry()
+
+func init() {
+	Registry.MustRegister(
+		activeConnections,
+		connections,
+		relayedBytes,
+		upstreamDialErrors,
+		upstreamDialDuration,
+		sessions,
+		tlsHandshakeFailures,
+		certificateExpiry,
+	)
+}
+
+// Connection counts a new connection of the service.  The returned function ends
+// it, it can be called more than once.
+func Connection(service string) (done func()) {
+	connections.WithLabelValues(service).Inc()
+	active := activeConnections.WithLabelValues(service)
+	active.Inc()
+	var ended int32
+	return func() {
+		if atomic.CompareAndSwapInt32(&ended, 0, 1) {
+			active.Dec()
+		}
+	}
+}
+
+// Copy is io.Copy that counts the bytes copied for the connection of the service
+// as they get written.
+func Copy(service string, direction string, dst io.Writer, src io.Reader) (int64, error) {
+	return io.Copy(&countingWriter{Writer: dst, counter: relayedBytes.WithLabelValues(service, direction)}, src)
+}
+
+// Relayed counts n bytes relayed for the service, like the ones of a datagram.
+func Relayed(service string, direction string, n int) {
+	relayedBytes.WithLabelValues(service, direction).Add(float64(n))
+}
+
+type countingWriter struct {
+	io.Writer
+	counter prometheus.Counter
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	w.counter.Add(float64(n))
+	return n, err
+}
+
+// UpstreamDial records the outcome of dialing the upstream of the service that
+// started at the given time.
+func UpstreamDial(service string, started time.Time, err error) {
+	if err != nil {
+		upstreamDialErrors.WithLabelValues(service).Inc()
+		return
+	}
+	upstreamDialDuration.WithLabelValues(service).Observe(time.Since(started).Seconds())
+}
+
+// SessionUp counts an ssh session that is up.  The returned function counts it
+// down.
+func SessionUp() (down func()) {
+	sessions.Inc()
+	var ended int32
+	return func() {
+		if atomic.CompareAndSwapInt32(&ended, 0, 1) {
+			sessions.Dec()
+		}
+	}
+}
+
+// TLSHandshakeFailed counts a failed TLS handshake.
+func TLSHandshakeFailed() {
+	tlsHandshakeFailures.Inc()
+}
+
+// SetCertificate sets the certificate whose expiry is reported.
+func SetCertificate(cert tls.Certificate) {
+	if len(cert.Certificate) == 0 {
+		return
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return
+	}
+	atomic.StoreInt64(&certificateNotAfter, leaf.NotAfter.Unix())
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
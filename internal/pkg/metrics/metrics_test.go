@@ -0,0 +1,47 @@
+package metrics_test
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/chirino/svcteleporter/internal/pkg/metrics"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	done := metrics.Connection("test")
+	_, err := metrics.Copy("test", metrics.In, ioutil.Discard, bytes.NewBufferString("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done()
+	done()
+	metrics.Relayed("test", metrics.Out, 3)
+	metrics.UpstreamDial("test", time.Now(), errors.New("connection refused"))
+	down := metrics.SessionUp()
+
+	server := httptest.NewServer(metrics.Handler())
+	defer server.Close()
+
+	response, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(t, string(body), `svcteleporter_service_connections_total{service="test"} 1`)
+	assert.Contains(t, string(body), `svcteleporter_service_active_connections{service="test"} 0`)
+	assert.Contains(t, string(body), `svcteleporter_service_bytes_total{direction="in",service="test"} 4`)
+	assert.Contains(t, string(body), `svcteleporter_service_bytes_total{direction="out",service="test"} 3`)
+	assert.Contains(t, string(body), `svcteleporter_upstream_dial_errors_total{service="test"} 1`)
+	assert.Contains(t, string(body), `svcteleporter_ssh_sessions 1`)
+	down()
+}
@@ -0,0 +1,202 @@
+// Package pki creates the certificate authority and the leaf certificates that
+// the importer and exporters use to authenticate each other.
+package pki
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// Key types that GenerateKey supports.
+const (
+	KeyTypeRSA       = "rsa"
+	KeyTypeECDSAP256 = "ecdsa-p256"
+	KeyTypeECDSAP384 = "ecdsa-p384"
+	KeyTypeEd25519   = "ed25519"
+)
+
+// KeyTypes lists the supported key types.
+var KeyTypes = []string{KeyTypeRSA, KeyTypeECDSAP256, KeyTypeECDSAP384, KeyTypeEd25519}
+
+// GenerateKey generates a private key of the given type.  keySize is only used
+// for rsa keys.
+func GenerateKey(keyType string, keySize int) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, keySize)
+	case KeyTypeECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeECDSAP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case KeyTypeEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	}
+	return nil, fmt.Errorf("invalid key type '%s', expecting one of: %s", keyType, strings.Join(KeyTypes, ", "))
+}
+
+// EncodeKey PEM encodes the private key in PKCS#8 form.
+func EncodeKey(key crypto.Signer) (string, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	out := bytes.NewBuffer(nil)
+	err = pem.Encode(out, &pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return out.String(), err
+}
+
+// CA is a certificate authority that issues the importer and exporter certificates.
+type CA struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+	// CertPEM and KeyPEM are the PEM encoded forms of Cert and Key.
+	CertPEM string
+	KeyPEM  string
+}
+
+// NewCA generates a self-signed certificate authority.
+func NewCA(keyType string, keySize int, duration time.Duration, commonName string) (*CA, error) {
+	key, err := GenerateKey(keyType, keySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate CA private key: %s", err)
+	}
+	template, err := newTemplate(duration, commonName)
+	if err != nil {
+		return nil, err
+	}
+	template.IsCA = true
+	template.MaxPathLenZero = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create CA certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := EncodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &CA{
+		Cert:    cert,
+		Key:     key,
+		CertPEM: encodeCert(der),
+		KeyPEM:  keyPEM,
+	}, nil
+}
+
+// LoadCA loads a certificate authority from its PEM encoded certificate and key.
+func LoadCA(certPEM string, keyPEM string) (*CA, error) {
+	pair, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return nil, fmt.Errorf("invalid CA: %v", err)
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("invalid CA: certificate %s is not a CA", cert.Subject.CommonName)
+	}
+	if cert.KeyUsage != 0 && cert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return nil, fmt.Errorf("invalid CA: certificate %s key usage does not allow signing certificates", cert.Subject.CommonName)
+	}
+	if time.Now().After(cert.NotAfter) {
+		return nil, fmt.Errorf("invalid CA: certificate %s expired on %s", cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339))
+	}
+	key, ok := pair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("invalid CA: unsupported private key type")
+	}
+	return &CA{
+		Cert:    cert,
+		Key:     key,
+		CertPEM: certPEM,
+		KeyPEM:  keyPEM,
+	}, nil
+}
+
+// Issue creates a leaf certificate signed by the CA for commonName that can be
+// used for the given extended key usages.  The common name is also added as the
+// DNS name of the certificate.
+func (ca *CA) Issue(keyType string, keySize int, duration time.Duration, commonName string, usages ...x509.ExtKeyUsage) (certPEM string, keyPEM string, err error) {
+	key, err := GenerateKey(keyType, keySize)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to generate private key: %s", err)
+	}
+	certPEM, err = ca.IssueForKey(key, duration, commonName, usages...)
+	if err != nil {
+		return "", "", err
+	}
+	keyPEM, err = EncodeKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	return certPEM, keyPEM, nil
+}
+
+// IssueForKey is Issue for an existing key, so that the certificate keeps the
+// public key of the one it replaces.
+func (ca *CA) IssueForKey(key crypto.Signer, duration time.Duration, commonName string, usages ...x509.ExtKeyUsage) (certPEM string, err error) {
+	template, err := newTemplate(duration, commonName)
+	if err != nil {
+		return "", err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+	template.ExtKeyUsage = usages
+	template.DNSNames = []string{commonName}
+	if template.NotAfter.After(ca.Cert.NotAfter) {
+		template.NotAfter = ca.Cert.NotAfter
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, key.Public(), ca.Key)
+	if err != nil {
+		return "", fmt.Errorf("failed to create certificate: %s", err)
+	}
+	return encodeCert(der), nil
+}
+
+func newTemplate(duration time.Duration, commonName string) (*x509.Certificate, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate serial number: %s", err)
+	}
+	notBefore := time.Now()
+	return &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"svcteleporter"},
+			CommonName:   commonName,
+		},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(duration),
+		BasicConstraintsValid: true,
+	}, nil
+}
+
+func encodeCert(der []byte) string {
+	out := bytes.NewBuffer(nil)
+	pem.Encode(out, &pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return out.String()
+}
@@ -0,0 +1,87 @@
+package pki
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+// ValidateCertificate checks that keyPEM holds the private key of the leaf
+// certificate in certPEM and that the certificate can be used for usage: it has
+// to be valid now, allow digital signatures and chain up to one of the cas.  Any
+// certificates that follow the leaf in certPEM are used as intermediates.
+func ValidateCertificate(certPEM string, keyPEM string, cas []string, usage x509.ExtKeyUsage) (*x509.Certificate, error) {
+	pair, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		return nil, err
+	}
+	certs := make([]*x509.Certificate, len(pair.Certificate))
+	for i, der := range pair.Certificate {
+		certs[i], err = x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cert := certs[0]
+
+	now := time.Now()
+	if now.Before(cert.NotBefore) {
+		return nil, fmt.Errorf("certificate %s is not valid before %s", cert.Subject.CommonName, cert.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(cert.NotAfter) {
+		return nil, fmt.Errorf("certificate %s expired on %s", cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339))
+	}
+	if cert.IsCA {
+		return nil, fmt.Errorf("certificate %s is a CA certificate", cert.Subject.CommonName)
+	}
+	if cert.KeyUsage != 0 && cert.KeyUsage&x509.KeyUsageDigitalSignature == 0 {
+		return nil, fmt.Errorf("certificate %s key usage does not allow digital signatures", cert.Subject.CommonName)
+	}
+	if !hasExtKeyUsage(cert, usage) {
+		return nil, fmt.Errorf("certificate %s is not valid for %s", cert.Subject.CommonName, extKeyUsageName(usage))
+	}
+
+	roots := x509.NewCertPool()
+	for _, ca := range cas {
+		if !roots.AppendCertsFromPEM([]byte(ca)) {
+			return nil, fmt.Errorf("no valid CA certificate found")
+		}
+	}
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		CurrentTime:   now,
+		Intermediates: x509.NewCertPool(),
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	for _, intermediate := range certs[1:] {
+		opts.Intermediates.AddCert(intermediate)
+	}
+	if _, err := cert.Verify(opts); err != nil {
+		return nil, fmt.Errorf("certificate %s is not trusted by the CA: %v", cert.Subject.CommonName, err)
+	}
+	return cert, nil
+}
+
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	// A certificate without extended key usages is valid for any usage.
+	if len(cert.ExtKeyUsage) == 0 {
+		return true
+	}
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage || u == x509.ExtKeyUsageAny {
+			return true
+		}
+	}
+	return false
+}
+
+func extKeyUsageName(usage x509.ExtKeyUsage) string {
+	switch usage {
+	case x509.ExtKeyUsageServerAuth:
+		return "server authentication"
+	case x509.ExtKeyUsageClientAuth:
+		return "client authentication"
+	}
+	return fmt.Sprintf("extended key usage %d", usage)
+}
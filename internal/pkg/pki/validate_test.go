@@ -0,0 +1,67 @@
+package pki
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateCertificate(t *testing.T) {
+	ca, err := NewCA(KeyTypeECDSAP256, 0, time.Hour, "test-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM, keyPEM, err := ca.Issue(KeyTypeECDSAP256, 0, time.Hour, "importer", x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := ValidateCertificate(certPEM, keyPEM, []string{ca.CertPEM}, x509.ExtKeyUsageServerAuth)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "importer", cert.Subject.CommonName)
+	}
+
+	_, err = ValidateCertificate(certPEM, keyPEM, []string{ca.CertPEM}, x509.ExtKeyUsageClientAuth)
+	assert.EqualError(t, err, "certificate importer is not valid for client authentication")
+
+	_, err = ValidateCertificate(ca.CertPEM, ca.KeyPEM, []string{ca.CertPEM}, x509.ExtKeyUsageServerAuth)
+	assert.EqualError(t, err, "certificate test-ca is a CA certificate")
+
+	_, otherKeyPEM, err := ca.Issue(KeyTypeECDSAP256, 0, time.Hour, "other", x509.ExtKeyUsageServerAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ValidateCertificate(certPEM, otherKeyPEM, []string{ca.CertPEM}, x509.ExtKeyUsageServerAuth)
+	assert.Error(t, err)
+
+	otherCA, err := NewCA(KeyTypeECDSAP256, 0, time.Hour, "other-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ValidateCertificate(certPEM, keyPEM, []string{otherCA.CertPEM}, x509.ExtKeyUsageServerAuth)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "is not trusted by the CA")
+
+	_, err = ValidateCertificate(certPEM, keyPEM, []string{"garbage"}, x509.ExtKeyUsageServerAuth)
+	assert.EqualError(t, err, "no valid CA certificate found")
+}
+
+func TestValidateExpiredCertificate(t *testing.T) {
+	ca, err := NewCA(KeyTypeECDSAP256, 0, -time.Hour, "expired-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = LoadCA(ca.CertPEM, ca.KeyPEM)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "expired on")
+
+	certPEM, keyPEM, err := ca.Issue(KeyTypeECDSAP256, 0, time.Hour, "exporter", x509.ExtKeyUsageClientAuth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ValidateCertificate(certPEM, keyPEM, []string{ca.CertPEM}, x509.ExtKeyUsageClientAuth)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "certificate exporter expired on")
+}
@@ -0,0 +1,78 @@
+// Package protocol holds the ssh extensions that the exporter and importer use
+// to talk to each other.
+package protocol
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	// ServiceForwardRequest is the global request an exporter sends to ask the
+	// importer to start accepting connections for a service.  The importer maps
+	// the service name to one of its configured listeners.
+	ServiceForwardRequest = "service-forward@svcteleporter"
+
+	// CancelServiceForwardRequest is the global request an exporter sends to ask the
+	// importer to stop accepting connections for a service.
+	CancelServiceForwardRequest = "cancel-service-forward@svcteleporter"
+
+	// ServiceForwardClosedRequest is the global request the importer sends to tell
+	// an exporter that it stopped accepting connections for a service, like when it
+	// could not listen on the new address of the service after a config change.
+	ServiceForwardClosedRequest = "service-forward-closed@svcteleporter"
+
+	// ForwardedServiceChannel is the channel type the importer opens to the
+	// exporter for every connection it accepts for a service.
+	ForwardedServiceChannel = "forwarded-service@svcteleporter"
+)
+
+// ServiceForward is the payload of the ServiceForwardRequest,
+// CancelServiceForwardRequest and ServiceForwardClosedRequest requests.
+type ServiceForward struct {
+	Service string
+}
+
+// ForwardedService is the extra data sent when opening a ForwardedServiceChannel.
+type ForwardedService struct {
+	Service    string
+	OriginAddr string
+	OriginPort uint32
+}
+
+// ForwardedDatagramChannel is the channel type the importer opens to the exporter
+// for every client address that sends datagrams to a udp service.  The datagrams
+// are framed with WriteDatagram and ReadDatagram.
+const ForwardedDatagramChannel = "forwarded-datagrams@svcteleporter"
+
+// MaxDatagramSize is the largest datagram that can be framed.
+const MaxDatagramSize = 0xffff
+
+// WriteDatagram writes the datagram to w prefixed with its length as a big
+// endian uint16.
+func WriteDatagram(w io.Writer, datagram []byte) error {
+	if len(datagram) > MaxDatagramSize {
+		return fmt.Errorf("datagram of %d bytes is too large", len(datagram))
+	}
+	frame := make([]byte, 2+len(datagram))
+	binary.BigEndian.PutUint16(frame, uint16(len(datagram)))
+	copy(frame[2:], datagram)
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadDatagram reads the next datagram written by WriteDatagram into buf, which
+// should be MaxDatagramSize bytes long.
+func ReadDatagram(r io.Reader, buf []byte) (int, error) {
+	header := [2]byte{}
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return 0, err
+	}
+	size := int(binary.BigEndian.Uint16(header[:]))
+	if size > len(buf) {
+		return 0, fmt.Errorf("datagram of %d bytes does not fit in a %d byte buffer", size, len(buf))
+	}
+	return io.ReadFull(r, buf[:size])
+}
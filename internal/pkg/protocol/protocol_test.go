@@ -0,0 +1,27 @@
+package protocol_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/chirino/svcteleporter/internal/pkg/protocol"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDatagramFraming(t *testing.T) {
+	assert := assert.New(t)
+	stream := bytes.NewBuffer(nil)
+	assert.NoError(protocol.WriteDatagram(stream, []byte("hello")))
+	assert.NoError(protocol.WriteDatagram(stream, []byte{}))
+	assert.NoError(protocol.WriteDatagram(stream, []byte("world!")))
+	assert.Error(protocol.WriteDatagram(stream, make([]byte, protocol.MaxDatagramSize+1)))
+
+	buf := make([]byte, protocol.MaxDatagramSize)
+	for _, expected := range []string{"hello", "", "world!"} {
+		n, err := protocol.ReadDatagram(stream, buf)
+		assert.NoError(err)
+		assert.Equal(expected, string(buf[:n]))
+	}
+	_, err := protocol.ReadDatagram(stream, buf)
+	assert.Error(err)
+}
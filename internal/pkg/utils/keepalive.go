@@ -0,0 +1,54 @@
+package utils
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const KeepAliveRequestType = "keepalive@openssh.com"
+
+// KeepAlive periodically sends keepalive@openssh.com global requests over the ssh
+// connection until the context is canceled.  Any reply, even a failure reply,
+// shows that the peer is still alive.  If maxMissed consecutive requests go
+// unanswered for an interval, the connection is closed so that the peer is
+// considered dead.
+func KeepAlive(ctx context.Context, conn ssh.Conn, interval time.Duration, maxMissed int, logPrefix string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	missed := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := conn.SendRequest(KeepAliveRequestType, true, nil)
+			reply <- err
+		}()
+
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-reply:
+			if err != nil {
+				// the connection is already closed.
+				return
+			}
+			missed = 0
+		case <-time.After(interval):
+			missed++
+			log.Printf("%skeepalive reply missed (%d of %d) from %s\n", logPrefix, missed, maxMissed, conn.RemoteAddr())
+			if missed >= maxMissed {
+				log.Printf("%speer %s is not responding, closing the connection\n", logPrefix, conn.RemoteAddr())
+				conn.Close()
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package utils_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chirino/svcteleporter/internal/pkg/utils"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+// stubConn is an ssh connection whose peer either answers every request right
+// away or never answers.
+type stubConn struct {
+	ssh.Conn
+	answers  bool
+	requests int32
+	closed   chan struct{}
+}
+
+func newStubConn(answers bool) *stubConn {
+	return &stubConn{answers: answers, closed: make(chan struct{})}
+}
+
+func (c *stubConn) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	atomic.AddInt32(&c.requests, 1)
+	if c.answers {
+		return false, nil, nil
+	}
+	<-c.closed
+	return false, nil, io.EOF
+}
+
+func (c *stubConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 22}
+}
+
+func (c *stubConn) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestKeepAliveClosesUnresponsivePeer(t *testing.T) {
+	conn := newStubConn(false)
+	done := make(chan struct{})
+	go func() {
+		utils.KeepAlive(context.Background(), conn, 10*time.Millisecond, 3, "test:")
+		close(done)
+	}()
+
+	select {
+	case <-conn.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the connection of the unresponsive peer was not closed")
+	}
+	<-done
+	assert.Equal(t, int32(3), atomic.LoadInt32(&conn.requests), "the connection should be closed after MaxMissed keepalives")
+}
+
+func TestKeepAliveKeepsResponsivePeer(t *testing.T) {
+	conn := newStubConn(true)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		utils.KeepAlive(ctx, conn, 10*time.Millisecond, 3, "test:")
+		close(done)
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	<-done
+	select {
+	case <-conn.closed:
+		t.Fatal("the connection of a responsive peer should not be closed")
+	default:
+	}
+	assert.True(t, atomic.LoadInt32(&conn.requests) > 3)
+}
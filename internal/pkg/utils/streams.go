@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Streams counts the connections that are being relayed so that a shutdown can
+// wait for them to finish.
+type Streams struct {
+	active int64
+}
+
+// Add counts a new stream.  The returned function ends it, it can be called more
+// than once.
+func (s *Streams) Add() (done func()) {
+	atomic.AddInt64(&s.active, 1)
+	var ended int32
+	return func() {
+		if atomic.CompareAndSwapInt32(&ended, 0, 1) {
+			atomic.AddInt64(&s.active, -1)
+		}
+	}
+}
+
+// Active returns the number of streams that have not ended yet.
+func (s *Streams) Active() int64 {
+	return atomic.LoadInt64(&s.active)
+}
+
+// Drain waits up to the timeout for all the streams to end.  It reports if they
+// did.
+func (s *Streams) Drain(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for s.Active() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
@@ -0,0 +1,27 @@
+package utils_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/chirino/svcteleporter/internal/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamsDrain(t *testing.T) {
+	streams := &utils.Streams{}
+	assert.True(t, streams.Drain(0))
+
+	first := streams.Add()
+	second := streams.Add()
+	second()
+	second()
+	assert.Equal(t, int64(1), streams.Active(), "ending a stream twice only counts once")
+	assert.False(t, streams.Drain(200*time.Millisecond))
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		first()
+	}()
+	assert.True(t, streams.Drain(5*time.Second))
+}
@@ -7,6 +7,7 @@ import (
 	"io"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -15,6 +16,12 @@ type websocketNetConn struct {
 	nextReader io.Reader
 	ctx        context.Context
 	logPrefix  string
+	// writeLock serializes the writes.  The write deadline is only applied by
+	// them since the ssh connection sets the deadlines from its reading and its
+	// writing goroutines.
+	writeLock     sync.Mutex
+	deadlineLock  sync.Mutex
+	writeDeadline time.Time
 }
 
 func (conn *websocketNetConn) Close() error {
@@ -69,6 +76,12 @@ func (conn *websocketNetConn) Write(b []byte) (int, error) {
 	if err != nil {
 		return 0, err
 	}
+	conn.deadlineLock.Lock()
+	deadline := conn.writeDeadline
+	conn.deadlineLock.Unlock()
+	conn.writeLock.Lock()
+	defer conn.writeLock.Unlock()
+	conn.Conn.SetWriteDeadline(deadline)
 	err = conn.WriteMessage(websocket.BinaryMessage, b)
 	if err != nil {
 		return 0, err
@@ -81,10 +94,14 @@ func (conn *websocketNetConn) SetDeadline(t time.Time) error {
 	if err != nil {
 		return err
 	}
-	err = conn.Conn.SetWriteDeadline(t)
-	if err != nil {
-		return err
-	}
+	return conn.SetWriteDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline of the next writes.
+func (conn *websocketNetConn) SetWriteDeadline(t time.Time) error {
+	conn.deadlineLock.Lock()
+	conn.writeDeadline = t
+	conn.deadlineLock.Unlock()
 	return nil
 }
 
@@ -127,26 +144,36 @@ func CopyWebSocketIO(ctx context.Context, websocketConnection *websocket.Conn, l
 type WsListener struct {
 	ctx       context.Context
 	ch        chan *websocket.Conn
+	done      chan struct{}
+	closeOnce sync.Once
 	logPrefix string
 }
 
+// Offer hands an upgraded web socket to the next Accept call.  The web socket
+// is closed if the listener gets closed before it is accepted.
 func (w *WsListener) Offer(ws *websocket.Conn) {
-	w.ch <- ws
+	select {
+	case w.ch <- ws:
+	case <-w.done:
+		ws.Close()
+	}
 }
 
 func (w *WsListener) Accept() (net.Conn, error) {
-	x, more := <-w.ch
-	if more {
+	select {
+	case x := <-w.ch:
 		log.Println(w.logPrefix + "accepted a connection")
 		conn := WebSocketToNetConn(w.ctx, x, w.logPrefix)
 		return conn, nil
-	} else {
+	case <-w.done:
 		return nil, fmt.Errorf("closed")
 	}
 }
 
 func (w *WsListener) Close() error {
-	close(w.ch)
+	w.closeOnce.Do(func() {
+		close(w.done)
+	})
 	return nil
 }
 
@@ -164,5 +191,5 @@ func (w *WsListener) String() string {
 
 func ToWSListener(ctx context.Context, logPrefix string) *WsListener {
 	ch := make(chan *websocket.Conn)
-	return &WsListener{ch: ch, ctx: ctx, logPrefix: logPrefix}
+	return &WsListener{ch: ch, done: make(chan struct{}), ctx: ctx, logPrefix: logPrefix}
 }